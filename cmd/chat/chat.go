@@ -15,9 +15,15 @@ import (
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sgostarter/liblog"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
 	"github.com/sgostarter/libp2p/pkg/peer"
 )
 
+func encodeMessage(msgID byte, msg interface{}) []byte {
+	md, _ := json.Marshal(msg)
+	return p2pio.AppendFrame(nil, append([]byte{msgID}, md...))
+}
+
 //
 //
 //
@@ -28,14 +34,7 @@ type baseMessage struct {
 }
 
 func (msg *baseMessage) Bytes() []byte {
-	var buf bytes.Buffer
-	buf.WriteByte(msg.MsgID)
-
-	md, _ := json.Marshal(msg)
-	d := make([]byte, 1024)
-	copy(d, buf.Bytes())
-	copy(d[1:], md)
-	return d
+	return encodeMessage(msg.MsgID, msg)
 }
 
 func (msg *baseMessage) ID() string {
@@ -63,14 +62,7 @@ type textMessage struct {
 }
 
 func (msg *textMessage) Bytes() []byte {
-	var buf bytes.Buffer
-	buf.WriteByte(msg.MsgID)
-
-	md, _ := json.Marshal(msg)
-	d := make([]byte, 1024)
-	copy(d, buf.Bytes())
-	copy(d[1:], md)
-	return d
+	return encodeMessage(msg.MsgID, msg)
 }
 
 type nickNameSetMessage struct {
@@ -84,14 +76,7 @@ func (msg *nickNameSetMessage) GossipFlag() bool {
 }
 
 func (msg *nickNameSetMessage) Bytes() []byte {
-	var buf bytes.Buffer
-	buf.WriteByte(msg.MsgID)
-
-	md, _ := json.Marshal(msg)
-	d := make([]byte, 1024)
-	copy(d, buf.Bytes())
-	copy(d[1:], md)
-	return d
+	return encodeMessage(msg.MsgID, msg)
 }
 
 //
@@ -138,8 +123,7 @@ type messageHelper struct {
 }
 
 func (mh *messageHelper) ReadMessage(reader io.Reader) (msg peer.Message, err error) {
-	buf := make([]byte, 1024)
-	_, err = reader.Read(buf)
+	buf, err := p2pio.ReadFrame(reader, 0)
 	if err != nil {
 		return
 	}
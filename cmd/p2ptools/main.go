@@ -6,7 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
 	"github.com/sgostarter/liblog"
@@ -17,10 +20,11 @@ import (
 )
 
 type discoveryObserver struct {
-	peers       []string
-	peersNewest []string
-	h           interface{}
-	hID         string
+	peersLock sync.Mutex
+	// peers maps the peers to the namespaces they are found in and when
+	peers map[string]map[string]time.Time
+	h     interface{}
+	hID   string
 }
 
 func (ob *discoveryObserver) NewHost(h interface{}, hID string) {
@@ -47,23 +51,44 @@ func (ob *discoveryObserver) StreamTalk(peerID string, rw *p2pio.ReadWriteCloser
 	_ = rw.Flush()
 }
 
-func (ob *discoveryObserver) OnNewPeerStart() {
-	ob.peersNewest = nil
-}
+func (ob *discoveryObserver) OnPeerFound(ev discovery.Event) {
+	ob.peersLock.Lock()
+	defer ob.peersLock.Unlock()
 
-func (ob *discoveryObserver) OnNewPeer(peerID string) {
-	ob.peersNewest = append(ob.peersNewest, peerID)
+	if ob.peers == nil {
+		ob.peers = make(map[string]map[string]time.Time)
+	}
+	if ob.peers[ev.PeerID] == nil {
+		ob.peers[ev.PeerID] = make(map[string]time.Time)
+	}
+	ob.peers[ev.PeerID][ev.Namespace] = ev.LastSeen
 }
 
-func (ob *discoveryObserver) OnNewPeerFinish() {
-	ob.peers = ob.peersNewest
-	ob.peersNewest = nil
+func (ob *discoveryObserver) OnPeerLost(ev discovery.Event) {
+	ob.peersLock.Lock()
+	defer ob.peersLock.Unlock()
+
+	delete(ob.peers[ev.PeerID], ev.Namespace)
+	if len(ob.peers[ev.PeerID]) == 0 {
+		delete(ob.peers, ev.PeerID)
+	}
 }
 
 func (ob *discoveryObserver) ListPeers() string {
+	ob.peersLock.Lock()
+	defer ob.peersLock.Unlock()
+
+	peers := make([]string, 0, len(ob.peers))
+	for peer := range ob.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
 	ss := &strings.Builder{}
-	for _, peer := range ob.peers {
-		ss.WriteString(fmt.Sprintf("%s\n", peer))
+	for _, peer := range peers {
+		for ns, foundAt := range ob.peers[peer] {
+			ss.WriteString(fmt.Sprintf("%s found in %q at %s\n", peer, ns, foundAt.Format(time.RFC3339)))
+		}
 	}
 	ss.WriteString("\n")
 	return ss.String()
@@ -102,11 +127,14 @@ func main() {
 	flag.BoolVar(&bootstrapMode, "bootstrap", false, "bootstrap mode")
 
 	var ns string
-	flag.StringVar(&ns, "ns", "TestAdvertiseNS", "advertise name space")
+	flag.StringVar(&ns, "ns", "TestAdvertiseNS", "advertise name spaces, separated by ;")
 
 	var bootstrapPeers string
 	flag.StringVar(&bootstrapPeers, "bspeer", "/ip4/172.28.89.156/tcp/4999/p2p/QmfAwEcZ9RpvXhRL1AWg6BSDBuvtzY2qw45KGNx6fZatBR", "boot strap peer")
 
+	var rendezvousPeers string
+	flag.StringVar(&rendezvousPeers, "rvpeer", "", "rendezvous points, the DHT is not used if set")
+
 	var protocolID string
 	flag.StringVar(&protocolID, "pid", "testProtocolID/1.0.0", "protocol id")
 
@@ -129,6 +157,7 @@ func main() {
 					UseIdentity: true,
 					PriKeyFile:  "priKey.dat",
 				},
+				EnableRendezvous: true,
 			})
 			if err != nil {
 				panic(err)
@@ -138,6 +167,11 @@ func main() {
 
 	ob := &discoveryObserver{}
 
+	var rendezvousPoints []string
+	if rendezvousPeers != "" {
+		rendezvousPoints = strings.Split(rendezvousPeers, ";")
+	}
+
 	go func() {
 		_ = discovery.RunServer(context.Background(), discovery.ServerParam{
 			HostParam: bootstrap.HostParam{
@@ -145,10 +179,12 @@ func main() {
 				UseIdentity: false,
 				PriKeyFile:  "",
 			},
-			ProtocolID:       protocolID,
-			BootstrapPeers:   strings.Split(bootstrapPeers, ";"),
-			AdvertiseNS:      ns,
-			MinCheckInterval: 0,
+			ProtocolID:          protocolID,
+			BootstrapPeers:      strings.Split(bootstrapPeers, ";"),
+			MinCheckInterval:    0,
+			AdvertiseNamespaces: strings.Split(ns, ";"),
+			DisableDHT:          len(rendezvousPoints) > 0,
+			RendezvousPoints:    rendezvousPoints,
 		}, ob)
 	}()
 
@@ -0,0 +1,161 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+var ErrDenied = errors.New("peer denied by acl")
+
+// ACL decides which peers may talk to us. A peer is denied if its ID or one of its addresses
+// matches a deny rule, otherwise it is allowed if there is no allow rule at all or its ID or one
+// of its addresses matches an allow rule. Addresses are multiaddr strings, CIDR rules match their
+// IP part. ACL is safe for concurrent use and may be changed at any time.
+type ACL struct {
+	lock       sync.RWMutex
+	allowIDs   map[string]interface{}
+	denyIDs    map[string]interface{}
+	allowCIDRs map[string]*net.IPNet
+	denyCIDRs  map[string]*net.IPNet
+	chChanged  chan struct{}
+}
+
+func New() *ACL {
+	return &ACL{
+		allowIDs:   make(map[string]interface{}),
+		denyIDs:    make(map[string]interface{}),
+		allowCIDRs: make(map[string]*net.IPNet),
+		denyCIDRs:  make(map[string]*net.IPNet),
+		chChanged:  make(chan struct{}),
+	}
+}
+
+// Changed returns a channel which is closed on the next change of the rules.
+func (acl *ACL) Changed() <-chan struct{} {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+
+	return acl.chChanged
+}
+
+// changed must be called with the write lock held.
+func (acl *ACL) changed() {
+	close(acl.chChanged)
+	acl.chChanged = make(chan struct{})
+}
+
+func (acl *ACL) AllowPeer(peerID string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	acl.allowIDs[peerID] = true
+	acl.changed()
+}
+
+func (acl *ACL) DenyPeer(peerID string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	acl.denyIDs[peerID] = true
+	acl.changed()
+}
+
+// RemovePeer removes the allow and deny rules of peerID.
+func (acl *ACL) RemovePeer(peerID string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	delete(acl.allowIDs, peerID)
+	delete(acl.denyIDs, peerID)
+	acl.changed()
+}
+
+func (acl *ACL) AllowCIDR(cidr string) error {
+	return acl.addCIDR(acl.allowCIDRs, cidr)
+}
+
+func (acl *ACL) DenyCIDR(cidr string) error {
+	return acl.addCIDR(acl.denyCIDRs, cidr)
+}
+
+func (acl *ACL) addCIDR(cidrs map[string]*net.IPNet, cidr string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	cidrs[cidr] = ipNet
+	acl.changed()
+	return nil
+}
+
+// RemoveCIDR removes the allow and deny rules of cidr.
+func (acl *ACL) RemoveCIDR(cidr string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	delete(acl.allowCIDRs, cidr)
+	delete(acl.denyCIDRs, cidr)
+	acl.changed()
+}
+
+func addrIP(addr string) net.IP {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil
+	}
+	for _, code := range []int{multiaddr.P_IP4, multiaddr.P_IP6} {
+		if v, err := ma.ValueForProtocol(code); err == nil {
+			return net.ParseIP(v)
+		}
+	}
+	return nil
+}
+
+func matchIPs(cidrs map[string]*net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		for _, ipNet := range cidrs {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check returns an error wrapping ErrDenied if peerID reached at addrs is denied.
+func (acl *ACL) Check(peerID string, addrs []string) error {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := addrIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+
+	if _, ok := acl.denyIDs[peerID]; ok {
+		return fmt.Errorf("%w: %v", ErrDenied, peerID)
+	}
+	if matchIPs(acl.denyCIDRs, ips) {
+		return fmt.Errorf("%w: %v address %v", ErrDenied, peerID, addrs)
+	}
+	if len(acl.allowIDs) == 0 && len(acl.allowCIDRs) == 0 {
+		return nil
+	}
+	if _, ok := acl.allowIDs[peerID]; ok {
+		return nil
+	}
+	if matchIPs(acl.allowCIDRs, ips) {
+		return nil
+	}
+	return fmt.Errorf("%w: %v not allowed", ErrDenied, peerID)
+}
@@ -0,0 +1,41 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	acl := New()
+	assert.Nil(t, acl.Check("a", nil))
+
+	chChanged := acl.Changed()
+	acl.DenyPeer("a")
+	select {
+	case <-chChanged:
+	default:
+		t.Fatal("no change notified")
+	}
+	assert.ErrorIs(t, acl.Check("a", nil), ErrDenied)
+	assert.Nil(t, acl.Check("b", nil))
+
+	assert.NotNil(t, acl.AllowCIDR("10.0.0.0/8x"))
+	assert.Nil(t, acl.AllowCIDR("10.0.0.0/8"))
+	assert.Nil(t, acl.Check("b", []string{"/ip4/10.1.2.3/tcp/4001"}))
+	assert.ErrorIs(t, acl.Check("b", []string{"/ip4/192.168.1.2/tcp/4001"}), ErrDenied)
+	assert.ErrorIs(t, acl.Check("b", nil), ErrDenied)
+
+	acl.AllowPeer("c")
+	assert.Nil(t, acl.Check("c", []string{"/ip4/192.168.1.2/tcp/4001"}))
+
+	assert.Nil(t, acl.DenyCIDR("10.1.0.0/16"))
+	assert.ErrorIs(t, acl.Check("b", []string{"/ip4/10.1.2.3/tcp/4001"}), ErrDenied)
+	assert.Nil(t, acl.Check("b", []string{"/ip4/10.2.2.3/tcp/4001"}))
+
+	acl.RemoveCIDR("10.1.0.0/16")
+	acl.RemovePeer("a")
+	assert.Nil(t, acl.Check("b", []string{"/ip4/10.1.2.3/tcp/4001"}))
+	assert.ErrorIs(t, acl.Check("a", nil), ErrDenied)
+	assert.Nil(t, acl.Check("a", []string{"/ip6/fe80::1/tcp/4001", "/ip4/10.0.0.1/tcp/4001"}))
+}
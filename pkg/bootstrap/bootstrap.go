@@ -21,6 +21,11 @@ type HostParam struct {
 
 type ServerParam struct {
 	HostParam
+	// DisableDHT runs the node without the server-mode DHT
+	DisableDHT bool
+	// EnableRendezvous makes the node a rendezvous point, see RendezvousClient
+	EnableRendezvous bool
+	Rendezvous       RendezvousPolicy
 }
 
 func getPriKeyFromFile(priKeyFile string) (crypto.PrivKey, error) {
@@ -71,9 +76,14 @@ func RunServer(ctx context.Context, param ServerParam) (err error) {
 
 	fmt.Println("This node: ", h.ID().Pretty(), " ", h.Addrs())
 
-	_, err = dht.New(ctx, h, dht.Mode(dht.ModeServer))
-	if err != nil {
-		return fmt.Errorf("new dht failed: %w", err)
+	if !param.DisableDHT {
+		_, err = dht.New(ctx, h, dht.Mode(dht.ModeServer))
+		if err != nil {
+			return fmt.Errorf("new dht failed: %w", err)
+		}
+	}
+	if param.EnableRendezvous {
+		startRendezvous(ctx, h, param.Rendezvous)
 	}
 
 	<-ctx.Done()
@@ -0,0 +1,301 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+)
+
+// RendezvousProtocolID is the protocol of the rendezvous point, every request is a stream
+// of JSON frames written by p2pio.WriteFrame.
+const RendezvousProtocolID = "/sgostarter/rendezvous/1.0.0"
+
+const (
+	rendezvousRegister    = "register"
+	rendezvousUnregister  = "unregister"
+	rendezvousDiscover    = "discover"
+	rendezvousSubscribe   = "subscribe"
+	rendezvousResponse    = "response"
+	rendezvousNotify      = "registration"
+	rendezvousMaxFrame    = 1 << 20
+	rendezvousMaxNSLength = 255
+)
+
+var (
+	ErrInvalidNamespace     = errors.New("invalid namespace")
+	ErrInvalidCookie        = errors.New("invalid cookie")
+	ErrInvalidTTL           = errors.New("invalid ttl")
+	ErrTooManyRegistrations = errors.New("too many registrations")
+	ErrTooManySubscriptions = errors.New("too many subscriptions")
+	ErrRendezvousRejected   = errors.New("rendezvous request rejected")
+)
+
+type rendezvousMessage struct {
+	Type      string `json:"type"`
+	Namespace string `json:"ns,omitempty"`
+	// TTL of a register request and its response, in seconds
+	TTL   int64    `json:"ttl,omitempty"`
+	Addrs []string `json:"addrs,omitempty"`
+	// Limit and Cookie page a discover request
+	Limit         int            `json:"limit,omitempty"`
+	Cookie        string         `json:"cookie,omitempty"`
+	Registrations []Registration `json:"registrations,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+func writeRendezvousMessage(rw *p2pio.ReadWriteCloser, msg *rendezvousMessage) error {
+	d, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err = p2pio.WriteFrame(rw, d); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+func readRendezvousMessage(rw *p2pio.ReadWriteCloser) (*rendezvousMessage, error) {
+	d, err := p2pio.ReadFrame(rw, rendezvousMaxFrame)
+	if err != nil {
+		return nil, err
+	}
+	msg := &rendezvousMessage{}
+	if err = json.Unmarshal(d, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// RendezvousPolicy limits the requests of a rendezvous point, the requests past the limits
+// are rejected.
+type RendezvousPolicy struct {
+	// DefaultTTL is the TTL of the registrations which ask for none, 2 hours if <= 0
+	DefaultTTL time.Duration
+	// MaxTTL is the longest TTL a registration may ask for, 72 hours if <= 0
+	MaxTTL time.Duration
+	// MaxLimit caps the registrations returned by a discover request, 1000 if <= 0
+	MaxLimit int
+	// MaxRegistrationsPerNamespace is 1000 if <= 0
+	MaxRegistrationsPerNamespace int
+	// MaxRegistrationsPerPeer is the count of namespaces a peer may register under, 100 if <= 0
+	MaxRegistrationsPerPeer int
+	// MaxSubscriptionsPerPeer is 100 if <= 0
+	MaxSubscriptionsPerPeer int
+	// RequestTimeout bounds the wait for the request of a new stream, 10 seconds if <= 0
+	RequestTimeout time.Duration
+}
+
+func (policy RendezvousPolicy) withDefaults() RendezvousPolicy {
+	if policy.DefaultTTL <= 0 {
+		policy.DefaultTTL = 2 * time.Hour
+	}
+	if policy.MaxTTL <= 0 {
+		policy.MaxTTL = 72 * time.Hour
+	}
+	if policy.DefaultTTL > policy.MaxTTL {
+		policy.DefaultTTL = policy.MaxTTL
+	}
+	if policy.MaxLimit <= 0 {
+		policy.MaxLimit = 1000
+	}
+	if policy.MaxRegistrationsPerNamespace <= 0 {
+		policy.MaxRegistrationsPerNamespace = 1000
+	}
+	if policy.MaxRegistrationsPerPeer <= 0 {
+		policy.MaxRegistrationsPerPeer = 100
+	}
+	if policy.MaxSubscriptionsPerPeer <= 0 {
+		policy.MaxSubscriptionsPerPeer = 100
+	}
+	if policy.RequestTimeout <= 0 {
+		policy.RequestTimeout = 10 * time.Second
+	}
+	return policy
+}
+
+type rendezvousService struct {
+	ctx      context.Context
+	policy   RendezvousPolicy
+	registry *registry
+}
+
+// startRendezvous serves the rendezvous protocol on h until ctx is done.
+func startRendezvous(ctx context.Context, h host.Host, policy RendezvousPolicy) *rendezvousService {
+	policy = policy.withDefaults()
+	svc := &rendezvousService{
+		ctx:      ctx,
+		policy:   policy,
+		registry: newRegistry(policy),
+	}
+	h.SetStreamHandler(RendezvousProtocolID, svc.handleStream)
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				h.RemoveStreamHandler(RendezvousProtocolID)
+				return
+			case now := <-ticker.C:
+				svc.registry.expire(now)
+			}
+		}
+	}()
+	return svc
+}
+
+func (svc *rendezvousService) handleStream(stream network.Stream) {
+	defer func() {
+		_ = stream.Close()
+	}()
+	peerID := stream.Conn().RemotePeer().Pretty()
+	rw := p2pio.NewReadWriteCloser(stream)
+
+	_ = stream.SetReadDeadline(time.Now().Add(svc.policy.RequestTimeout))
+	req, err := readRendezvousMessage(rw)
+	if err != nil {
+		loge.Warnf(svc.ctx, "rendezvous read request of %v failed: %v", peerID, err)
+		_ = stream.Reset()
+		return
+	}
+	// a subscriber keeps the stream open
+	_ = stream.SetReadDeadline(time.Time{})
+
+	var resp *rendezvousMessage
+	switch {
+	case req.Namespace == "" || len(req.Namespace) > rendezvousMaxNSLength:
+		resp = &rendezvousMessage{Error: ErrInvalidNamespace.Error()}
+	case req.Type == rendezvousRegister:
+		resp = svc.register(peerID, stream.Conn().RemoteMultiaddr(), req)
+	case req.Type == rendezvousUnregister:
+		svc.registry.unregister(req.Namespace, peerID)
+		resp = &rendezvousMessage{}
+	case req.Type == rendezvousDiscover:
+		resp = svc.discover(req)
+	case req.Type == rendezvousSubscribe:
+		if resp = svc.subscribe(rw, peerID, req.Namespace); resp == nil {
+			return
+		}
+	default:
+		resp = &rendezvousMessage{Error: "unknown request " + req.Type}
+	}
+
+	resp.Type = rendezvousResponse
+	if err = writeRendezvousMessage(rw, resp); err != nil {
+		loge.Warnf(svc.ctx, "rendezvous write response to %v failed: %v", peerID, err)
+	}
+}
+
+func (svc *rendezvousService) register(peerID string, remoteAddr multiaddr.Multiaddr, req *rendezvousMessage) *rendezvousMessage {
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = svc.policy.DefaultTTL
+	}
+	if ttl > svc.policy.MaxTTL {
+		return &rendezvousMessage{Error: fmt.Sprintf("%v: %v is over %v", ErrInvalidTTL, ttl, svc.policy.MaxTTL)}
+	}
+	addrs := sameIPAddrs(req.Addrs, remoteAddr)
+
+	err := svc.registry.register(Registration{
+		Namespace: req.Namespace,
+		PeerID:    peerID,
+		Addrs:     addrs,
+		TTL:       int64(ttl / time.Second),
+	}, time.Now())
+	if err != nil {
+		return &rendezvousMessage{Error: err.Error()}
+	}
+	return &rendezvousMessage{TTL: int64(ttl / time.Second)}
+}
+
+// sameIPAddrs keeps the addrs on the IP the registering peer connects from, so that it can't
+// make the other peers dial somebody else. remoteAddr is used if no addr is left.
+func sameIPAddrs(addrs []string, remoteAddr multiaddr.Multiaddr) []string {
+	remoteIP := addrIP(remoteAddr)
+	kept := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		if ip := addrIP(ma); ip != "" && ip == remoteIP {
+			kept = append(kept, ma.String())
+		}
+	}
+	if len(kept) == 0 {
+		kept = append(kept, remoteAddr.String())
+	}
+	return kept
+}
+
+func addrIP(ma multiaddr.Multiaddr) string {
+	if ip, err := ma.ValueForProtocol(multiaddr.P_IP4); err == nil {
+		return ip
+	}
+	if ip, err := ma.ValueForProtocol(multiaddr.P_IP6); err == nil {
+		return ip
+	}
+	return ""
+}
+
+func (svc *rendezvousService) discover(req *rendezvousMessage) *rendezvousMessage {
+	limit := req.Limit
+	if limit <= 0 || limit > svc.policy.MaxLimit {
+		limit = svc.policy.MaxLimit
+	}
+	regs, cookie, err := svc.registry.discover(req.Namespace, limit, req.Cookie, time.Now())
+	if err != nil {
+		return &rendezvousMessage{Error: err.Error()}
+	}
+	return &rendezvousMessage{Registrations: regs, Cookie: cookie}
+}
+
+// subscribe writes the new registrations of ns to the stream until it is closed by the
+// subscriber or the service is done. It returns the response rejecting the subscription,
+// nil once the subscription is over.
+func (svc *rendezvousService) subscribe(rw *p2pio.ReadWriteCloser, peerID, ns string) *rendezvousMessage {
+	chRegs, cancel, err := svc.registry.subscribe(ns, peerID)
+	if err != nil {
+		return &rendezvousMessage{Error: err.Error()}
+	}
+	defer cancel()
+
+	if err = writeRendezvousMessage(rw, &rendezvousMessage{Type: rendezvousResponse}); err != nil {
+		return nil
+	}
+
+	// the subscriber sends nothing more, a read returns when it closes the stream
+	chClosed := make(chan interface{})
+	go func() {
+		_, _ = readRendezvousMessage(rw)
+		close(chClosed)
+	}()
+
+	for {
+		select {
+		case <-svc.ctx.Done():
+			return nil
+		case <-chClosed:
+			return nil
+		case reg := <-chRegs:
+			err = writeRendezvousMessage(rw, &rendezvousMessage{
+				Type:          rendezvousNotify,
+				Namespace:     ns,
+				Registrations: []Registration{reg},
+			})
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
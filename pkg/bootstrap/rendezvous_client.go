@@ -0,0 +1,238 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+)
+
+// RendezvousClient talks to a rendezvous point, it implements the libp2p Discovery so it can
+// back a discovery.RendezvousDiscoverer.
+type RendezvousClient struct {
+	h      host.Host
+	server peer.ID
+}
+
+// NewRendezvousClient returns the client of the rendezvous point at serverAddr, a multiaddr
+// ending with /p2p/<id>.
+func NewRendezvousClient(h host.Host, serverAddr string) (*RendezvousClient, error) {
+	ma, err := multiaddr.NewMultiaddr(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	info, err := peer.AddrInfoFromP2pAddr(ma)
+	if err != nil {
+		return nil, err
+	}
+	h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+
+	return &RendezvousClient{
+		h:      h,
+		server: info.ID,
+	}, nil
+}
+
+// ServerID returns the peer ID of the rendezvous point.
+func (client *RendezvousClient) ServerID() string {
+	return client.server.Pretty()
+}
+
+func (client *RendezvousClient) open(ctx context.Context) (*p2pio.ReadWriteCloser, error) {
+	stream, err := client.h.NewStream(ctx, client.server, RendezvousProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	return p2pio.NewReadWriteCloser(stream), nil
+}
+
+func (client *RendezvousClient) request(ctx context.Context, req *rendezvousMessage) (*rendezvousMessage, error) {
+	rw, err := client.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rw.Close()
+	}()
+
+	if err = writeRendezvousMessage(rw, req); err != nil {
+		return nil, err
+	}
+	resp, err := readRendezvousMessage(rw)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %v", ErrRendezvousRejected, resp.Error)
+	}
+	return resp, nil
+}
+
+// Register registers the host under ns for ttl, the rendezvous point decides the TTL if it is
+// zero, and returns the TTL granted. The rendezvous point only keeps the addresses on the IP
+// the host connects from.
+func (client *RendezvousClient) Register(ctx context.Context, ns string, ttl time.Duration) (time.Duration, error) {
+	addrs := make([]string, 0, len(client.h.Addrs()))
+	for _, addr := range client.h.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	resp, err := client.request(ctx, &rendezvousMessage{
+		Type:      rendezvousRegister,
+		Namespace: ns,
+		TTL:       int64(ttl / time.Second),
+		Addrs:     addrs,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+func (client *RendezvousClient) Unregister(ctx context.Context, ns string) error {
+	_, err := client.request(ctx, &rendezvousMessage{
+		Type:      rendezvousUnregister,
+		Namespace: ns,
+	})
+	return err
+}
+
+// Discover returns at most limit peers registered under ns after cookie, the empty cookie
+// starts from the oldest registration, and the cookie of the next page.
+func (client *RendezvousClient) Discover(ctx context.Context, ns string, limit int, cookie string) ([]peer.AddrInfo, string, error) {
+	resp, err := client.request(ctx, &rendezvousMessage{
+		Type:      rendezvousDiscover,
+		Namespace: ns,
+		Limit:     limit,
+		Cookie:    cookie,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return client.addrInfos(resp.Registrations), resp.Cookie, nil
+}
+
+// Subscribe returns the channel of the peers registering under ns from now on, it is closed
+// when ctx is done or the rendezvous point is gone.
+func (client *RendezvousClient) Subscribe(ctx context.Context, ns string) (<-chan peer.AddrInfo, error) {
+	rw, err := client.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = writeRendezvousMessage(rw, &rendezvousMessage{
+		Type:      rendezvousSubscribe,
+		Namespace: ns,
+	})
+	if err == nil {
+		var resp *rendezvousMessage
+		if resp, err = readRendezvousMessage(rw); err == nil && resp.Error != "" {
+			err = fmt.Errorf("%w: %v", ErrRendezvousRejected, resp.Error)
+		}
+	}
+	if err != nil {
+		_ = rw.Close()
+		return nil, err
+	}
+
+	chPeers := make(chan peer.AddrInfo, defaultSubscriptionBufferSize)
+	go func() {
+		<-ctx.Done()
+		_ = rw.Close()
+	}()
+	go func() {
+		defer close(chPeers)
+
+		for {
+			msg, err := readRendezvousMessage(rw)
+			if err != nil {
+				if ctx.Err() == nil {
+					loge.Warnf(ctx, "rendezvous subscription of %v closed: %v", ns, err)
+				}
+				return
+			}
+			for _, pi := range client.addrInfos(msg.Registrations) {
+				select {
+				case chPeers <- pi:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return chPeers, nil
+}
+
+// addrInfos converts the registrations of the other peers, their addresses are added to the
+// peerstore for the TTL of the registrations.
+func (client *RendezvousClient) addrInfos(regs []Registration) []peer.AddrInfo {
+	infos := make([]peer.AddrInfo, 0, len(regs))
+	for _, reg := range regs {
+		id, err := peer.Decode(reg.PeerID)
+		if err != nil || id == client.h.ID() {
+			continue
+		}
+		pi := peer.AddrInfo{ID: id}
+		for _, addr := range reg.Addrs {
+			ma, err := multiaddr.NewMultiaddr(addr)
+			if err != nil {
+				continue
+			}
+			pi.Addrs = append(pi.Addrs, ma)
+		}
+		client.h.Peerstore().AddAddrs(id, pi.Addrs, time.Duration(reg.TTL)*time.Second)
+		infos = append(infos, pi)
+	}
+	return infos
+}
+
+// Advertise implements the libp2p Advertiser.
+func (client *RendezvousClient) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return 0, err
+	}
+	return client.Register(ctx, ns, options.Ttl)
+}
+
+// FindPeers implements the libp2p Discoverer, it pages through all the registrations of ns
+// unless the Limit option is set.
+func (client *RendezvousClient) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	var infos []peer.AddrInfo
+	cookie := ""
+	for {
+		limit := 0
+		if options.Limit > 0 {
+			limit = options.Limit - len(infos)
+		}
+		page, nextCookie, err := client.Discover(ctx, ns, limit, cookie)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, page...)
+		if nextCookie == cookie || (options.Limit > 0 && len(infos) >= options.Limit) {
+			break
+		}
+		cookie = nextCookie
+	}
+
+	chPeers := make(chan peer.AddrInfo, len(infos))
+	for _, pi := range infos {
+		chPeers <- pi
+	}
+	close(chPeers)
+	return chPeers, nil
+}
@@ -0,0 +1,210 @@
+package bootstrap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultSubscriptionBufferSize = 32
+
+// Registration is a peer registered under a namespace of a rendezvous point.
+type Registration struct {
+	Namespace string   `json:"ns"`
+	PeerID    string   `json:"peer_id"`
+	Addrs     []string `json:"addrs"`
+	// TTL is the lifetime of the registration in seconds
+	TTL int64 `json:"ttl"`
+
+	seq    uint64
+	expire time.Time
+}
+
+// registry keeps the registrations of a rendezvous point. Every registration gets a sequence
+// number when it is made or refreshed, a discover cookie is the last sequence number a client
+// has seen, so paging a namespace also returns the registrations made since. The registrations
+// and the subscriptions are capped by the policy.
+type registry struct {
+	policy RendezvousPolicy
+
+	lock       sync.Mutex
+	seq        uint64
+	namespaces map[string]map[string]*Registration
+	peerRegs   map[string]int
+	nextSubID  int
+	subs       map[string]map[int]chan Registration
+	peerSubs   map[string]int
+}
+
+func newRegistry(policy RendezvousPolicy) *registry {
+	return &registry{
+		policy:     policy.withDefaults(),
+		namespaces: make(map[string]map[string]*Registration),
+		peerRegs:   make(map[string]int),
+		subs:       make(map[string]map[int]chan Registration),
+		peerSubs:   make(map[string]int),
+	}
+}
+
+// register makes or refreshes a registration, a new one is rejected with ErrTooManyRegistrations
+// if its namespace or its peer has too many.
+func (r *registry) register(reg Registration, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	regs := r.namespaces[reg.Namespace]
+	if _, ok := regs[reg.PeerID]; !ok {
+		if len(regs) >= r.policy.MaxRegistrationsPerNamespace ||
+			r.peerRegs[reg.PeerID] >= r.policy.MaxRegistrationsPerPeer {
+			r.expireLocked(now)
+			regs = r.namespaces[reg.Namespace]
+		}
+		if len(regs) >= r.policy.MaxRegistrationsPerNamespace {
+			return fmt.Errorf("%w: namespace %v is full", ErrTooManyRegistrations, reg.Namespace)
+		}
+		if r.peerRegs[reg.PeerID] >= r.policy.MaxRegistrationsPerPeer {
+			return fmt.Errorf("%w: %v is registered under %v namespaces", ErrTooManyRegistrations,
+				reg.PeerID, r.peerRegs[reg.PeerID])
+		}
+		if regs == nil {
+			regs = make(map[string]*Registration)
+			r.namespaces[reg.Namespace] = regs
+		}
+		r.peerRegs[reg.PeerID]++
+	}
+
+	r.seq++
+	reg.seq = r.seq
+	reg.expire = now.Add(time.Duration(reg.TTL) * time.Second)
+	regs[reg.PeerID] = &reg
+
+	for _, ch := range r.subs[reg.Namespace] {
+		select {
+		case ch <- reg:
+		default:
+		}
+	}
+	return nil
+}
+
+func (r *registry) unregister(ns, peerID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.removeLocked(ns, peerID)
+}
+
+// removeLocked drops the registration of peerID under ns, it must be called with the lock held.
+func (r *registry) removeLocked(ns, peerID string) {
+	regs := r.namespaces[ns]
+	if _, ok := regs[peerID]; !ok {
+		return
+	}
+	delete(regs, peerID)
+	if len(regs) == 0 {
+		delete(r.namespaces, ns)
+	}
+	if r.peerRegs[peerID]--; r.peerRegs[peerID] <= 0 {
+		delete(r.peerRegs, peerID)
+	}
+}
+
+// discover returns at most limit registrations of ns made after cookie and the cookie of the
+// next page.
+func (r *registry) discover(ns string, limit int, cookie string, now time.Time) ([]Registration, string, error) {
+	var after uint64
+	if cookie != "" {
+		var err error
+		if after, err = strconv.ParseUint(cookie, 10, 64); err != nil {
+			return nil, "", ErrInvalidCookie
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var regs []Registration
+	for peerID, reg := range r.namespaces[ns] {
+		if !now.Before(reg.expire) {
+			r.removeLocked(ns, peerID)
+			continue
+		}
+		if reg.seq > after {
+			regs = append(regs, *reg)
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].seq < regs[j].seq
+	})
+	if limit > 0 && len(regs) > limit {
+		regs = regs[:limit]
+	}
+
+	if len(regs) > 0 {
+		after = regs[len(regs)-1].seq
+	}
+	for idx := range regs {
+		regs[idx].TTL = int64(regs[idx].expire.Sub(now) / time.Second)
+	}
+	return regs, strconv.FormatUint(after, 10), nil
+}
+
+// subscribe returns the channel of the new registrations of ns and the function which cancels
+// the subscription of peerID, it fails with ErrTooManySubscriptions if peerID has too many.
+// A registration is dropped for a subscriber whose channel is full.
+func (r *registry) subscribe(ns, peerID string) (<-chan Registration, func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.peerSubs[peerID] >= r.policy.MaxSubscriptionsPerPeer {
+		return nil, nil, fmt.Errorf("%w: %v has %v subscriptions", ErrTooManySubscriptions,
+			peerID, r.peerSubs[peerID])
+	}
+	r.peerSubs[peerID]++
+
+	ch := make(chan Registration, defaultSubscriptionBufferSize)
+	subs, ok := r.subs[ns]
+	if !ok {
+		subs = make(map[int]chan Registration)
+		r.subs[ns] = subs
+	}
+	id := r.nextSubID
+	r.nextSubID++
+	subs[id] = ch
+
+	return ch, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		if _, ok := r.subs[ns][id]; ok {
+			delete(r.subs[ns], id)
+			if len(r.subs[ns]) == 0 {
+				delete(r.subs, ns)
+			}
+			if r.peerSubs[peerID]--; r.peerSubs[peerID] <= 0 {
+				delete(r.peerSubs, peerID)
+			}
+			close(ch)
+		}
+	}, nil
+}
+
+// expire drops the registrations which are out of date.
+func (r *registry) expire(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expireLocked(now)
+}
+
+func (r *registry) expireLocked(now time.Time) {
+	for ns, regs := range r.namespaces {
+		for peerID, reg := range regs {
+			if !now.Before(reg.expire) {
+				r.removeLocked(ns, peerID)
+			}
+		}
+	}
+}
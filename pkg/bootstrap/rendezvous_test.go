@@ -0,0 +1,206 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	loge.SetGlobalLogger(loge.NewLogger(&loge.EmptyLogger{}))
+}
+
+func TestRegistry(t *testing.T) {
+	now := time.Now()
+	r := newRegistry(RendezvousPolicy{})
+	chRegs, cancel, err := r.subscribe("ns", "s")
+	assert.Nil(t, err)
+
+	for idx := 0; idx < 5; idx++ {
+		assert.Nil(t, r.register(Registration{Namespace: "ns", PeerID: fmt.Sprint(idx), TTL: 60}, now))
+	}
+	assert.Nil(t, r.register(Registration{Namespace: "other", PeerID: "x", TTL: 60}, now))
+	assert.Len(t, chRegs, 5)
+
+	regs, cookie, err := r.discover("ns", 3, "", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0", "1", "2"}, regPeerIDs(regs))
+	regs, cookie, err = r.discover("ns", 3, cookie, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3", "4"}, regPeerIDs(regs))
+	regs, cookie2, err := r.discover("ns", 3, cookie, now)
+	assert.Nil(t, err)
+	assert.Empty(t, regs)
+	assert.Equal(t, cookie, cookie2)
+
+	// a refreshed registration is seen again by the cookie
+	assert.Nil(t, r.register(Registration{Namespace: "ns", PeerID: "1", TTL: 120}, now))
+	regs, _, err = r.discover("ns", 3, cookie, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1"}, regPeerIDs(regs))
+	assert.EqualValues(t, 120, regs[0].TTL)
+
+	r.unregister("ns", "0")
+	regs, _, err = r.discover("ns", 0, "", now.Add(90*time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1"}, regPeerIDs(regs))
+	assert.EqualValues(t, 30, regs[0].TTL)
+
+	_, _, err = r.discover("ns", 0, "bad", now)
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+
+	r.expire(now.Add(time.Hour))
+	assert.Empty(t, r.namespaces)
+	assert.Empty(t, r.peerRegs)
+
+	cancel()
+	_, ok := <-chRegs
+	assert.True(t, ok)
+	cancel()
+	assert.Empty(t, r.peerSubs)
+}
+
+func TestRegistryLimits(t *testing.T) {
+	now := time.Now()
+	r := newRegistry(RendezvousPolicy{
+		MaxRegistrationsPerNamespace: 2,
+		MaxRegistrationsPerPeer:      2,
+		MaxSubscriptionsPerPeer:      1,
+	})
+
+	assert.Nil(t, r.register(Registration{Namespace: "ns", PeerID: "a", TTL: 60}, now))
+	assert.Nil(t, r.register(Registration{Namespace: "ns", PeerID: "b", TTL: 10}, now))
+	err := r.register(Registration{Namespace: "ns", PeerID: "c", TTL: 60}, now)
+	assert.ErrorIs(t, err, ErrTooManyRegistrations)
+	// a refresh is no new registration
+	assert.Nil(t, r.register(Registration{Namespace: "ns", PeerID: "a", TTL: 60}, now))
+	// the registrations out of date make room
+	assert.Nil(t, r.register(Registration{Namespace: "ns", PeerID: "c", TTL: 60}, now.Add(10*time.Second)))
+
+	assert.Nil(t, r.register(Registration{Namespace: "other", PeerID: "a", TTL: 60}, now))
+	err = r.register(Registration{Namespace: "third", PeerID: "a", TTL: 60}, now)
+	assert.ErrorIs(t, err, ErrTooManyRegistrations)
+	r.unregister("other", "a")
+	assert.Nil(t, r.register(Registration{Namespace: "third", PeerID: "a", TTL: 60}, now))
+
+	_, cancel, err := r.subscribe("ns", "a")
+	assert.Nil(t, err)
+	_, _, err = r.subscribe("other", "a")
+	assert.ErrorIs(t, err, ErrTooManySubscriptions)
+	_, cancelB, err := r.subscribe("ns", "b")
+	assert.Nil(t, err)
+	cancelB()
+	cancel()
+	_, _, err = r.subscribe("other", "a")
+	assert.Nil(t, err)
+}
+
+func regPeerIDs(regs []Registration) []string {
+	ids := make([]string, 0, len(regs))
+	for _, reg := range regs {
+		ids = append(ids, reg.PeerID)
+	}
+	return ids
+}
+
+func TestRendezvous(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	server, err := NewHost(ctx, &HostParam{})
+	assert.Nil(t, err)
+	defer func() {
+		_ = server.Close()
+	}()
+	startRendezvous(ctx, server, RendezvousPolicy{MaxTTL: time.Hour, RequestTimeout: 200 * time.Millisecond})
+	port, err := server.Addrs()[0].ValueForProtocol(multiaddr.P_TCP)
+	assert.Nil(t, err)
+	serverAddr := fmt.Sprintf("/ip4/127.0.0.1/tcp/%v/p2p/%v", port, server.ID().Pretty())
+
+	newClient := func() *RendezvousClient {
+		h, err := NewHost(ctx, &HostParam{})
+		assert.Nil(t, err)
+		t.Cleanup(func() {
+			_ = h.Close()
+		})
+		client, err := NewRendezvousClient(h, serverAddr)
+		assert.Nil(t, err)
+		return client
+	}
+	a, b := newClient(), newClient()
+
+	chPeers, err := a.Subscribe(ctx, "ns")
+	assert.Nil(t, err)
+
+	_, err = b.Register(ctx, "ns", 2*time.Hour)
+	assert.ErrorIs(t, err, ErrRendezvousRejected)
+	ttl, err := b.Register(ctx, "ns", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, ttl)
+	select {
+	case pi := <-chPeers:
+		assert.Equal(t, b.h.ID(), pi.ID)
+		assert.NotEmpty(t, pi.Addrs)
+	case <-ctx.Done():
+		t.Fatal("no registration notified")
+	}
+
+	_, err = a.Advertise(ctx, "ns")
+	assert.Nil(t, err)
+	chFound, err := b.FindPeers(ctx, "ns")
+	assert.Nil(t, err)
+	var found []string
+	for pi := range chFound {
+		found = append(found, pi.ID.Pretty())
+	}
+	assert.Equal(t, []string{a.h.ID().Pretty()}, found)
+
+	assert.Nil(t, b.Unregister(ctx, "ns"))
+	infos, _, err := a.Discover(ctx, "ns", 0, "")
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+
+	_, _, err = a.Discover(ctx, "", 0, "")
+	assert.ErrorIs(t, err, ErrRendezvousRejected)
+
+	// the addresses of somebody else are not registered
+	_, err = a.request(ctx, &rendezvousMessage{
+		Type:      rendezvousRegister,
+		Namespace: "other",
+		Addrs:     []string{"/ip4/10.1.2.3/tcp/4001"},
+	})
+	assert.Nil(t, err)
+	infos, _, err = b.Discover(ctx, "other", 0, "")
+	assert.Nil(t, err)
+	if assert.Len(t, infos, 1) && assert.Len(t, infos[0].Addrs, 1) {
+		assert.True(t, strings.HasPrefix(infos[0].Addrs[0].String(), "/ip4/127.0.0.1/"))
+	}
+
+	// a stream without request is closed
+	rw, err := a.open(ctx)
+	assert.Nil(t, err)
+	start := time.Now()
+	_, err = readRendezvousMessage(rw)
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestSameIPAddrs(t *testing.T) {
+	remoteAddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/5555")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"/ip4/127.0.0.1/tcp/4001"}, sameIPAddrs([]string{
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/10.1.2.3/tcp/4001",
+		"/dns4/example.com/tcp/4001",
+		"bad",
+	}, remoteAddr))
+	assert.Equal(t, []string{"/ip4/127.0.0.1/tcp/5555"}, sameIPAddrs([]string{"/ip4/10.1.2.3/tcp/4001"}, remoteAddr))
+	assert.Equal(t, []string{"/ip4/127.0.0.1/tcp/5555"}, sameIPAddrs(nil, remoteAddr))
+}
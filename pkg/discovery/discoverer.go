@@ -0,0 +1,297 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	coreDiscovery "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+// Event reports a peer a Discoverer found or lost.
+type Event struct {
+	PeerID string
+	// Source is the Name of the Discoverer which reported the peer
+	Source string
+	// Namespace is where the Discoverer found the peer, it is empty for the Discoverers
+	// without namespaces
+	Namespace string
+	Lost      bool
+	// LastSeen is when the peer was last reported, it is set by RunServer
+	LastSeen time.Time
+}
+
+// Discoverer is a source of peers, RunServer runs several of them together and merges what
+// they report.
+type Discoverer interface {
+	// Name tags the Events of the Discoverer, it should be unique among the Discoverers of a
+	// server.
+	Name() string
+	// Run reports the peers found and lost by emit until ctx is done. The addresses of the
+	// peers found must be in the peerstore of h, so that they can be dialed.
+	Run(ctx context.Context, h host.Host, emit func(Event)) error
+}
+
+// peerSet tracks the peers a Discoverer currently reports and emits the changes.
+type peerSet struct {
+	source    string
+	namespace string
+	emit      func(Event)
+	ids       map[peer.ID]bool
+}
+
+func newPeerSet(source, namespace string, emit func(Event)) *peerSet {
+	return &peerSet{
+		source:    source,
+		namespace: namespace,
+		emit:      emit,
+		ids:       make(map[peer.ID]bool),
+	}
+}
+
+func (set *peerSet) add(id peer.ID) {
+	if set.ids[id] {
+		return
+	}
+	set.ids[id] = true
+	set.emit(Event{PeerID: id.Pretty(), Source: set.source, Namespace: set.namespace})
+}
+
+func (set *peerSet) remove(id peer.ID) {
+	if !set.ids[id] {
+		return
+	}
+	delete(set.ids, id)
+	set.emit(Event{PeerID: id.Pretty(), Source: set.source, Namespace: set.namespace, Lost: true})
+}
+
+// update replaces the set by ids, the peers not in ids any more are lost.
+func (set *peerSet) update(ids map[peer.ID]bool) {
+	for id := range set.ids {
+		if !ids[id] {
+			set.remove(id)
+		}
+	}
+	for id := range ids {
+		set.add(id)
+	}
+}
+
+// Subscriber is a Discoverer which also notifies the peers as they show up in a namespace,
+// like bootstrap.RendezvousClient. The channel is closed when ctx is done or the subscription
+// is lost.
+type Subscriber interface {
+	Subscribe(ctx context.Context, ns string) (<-chan peer.AddrInfo, error)
+}
+
+// pollDiscovery queries d for the peers of ns every interval, and if d is a Subscriber adds
+// the peers it notifies in between. The result of a failed query is ignored, so a flaky
+// backend does not lose all its peers at once.
+func pollDiscovery(ctx context.Context, h host.Host, d coreDiscovery.Discoverer, ns string,
+	interval time.Duration, set *peerSet) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	sub, _ := d.(Subscriber)
+	var chNotified <-chan peer.AddrInfo
+	for {
+		// subscribe before the query, so that no peer is missed in between
+		if sub != nil && chNotified == nil {
+			var err error
+			if chNotified, err = sub.Subscribe(ctx, ns); err != nil && ctx.Err() == nil {
+				loge.Errorf(ctx, "%v subscribe %v failed: %v", set.source, ns, err)
+			}
+		}
+
+		peerChan, err := d.FindPeers(ctx, ns)
+		if err == nil {
+			ids := make(map[peer.ID]bool)
+			for pi := range peerChan {
+				if addFoundPeer(h, pi) {
+					ids[pi.ID] = true
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			set.update(ids)
+		} else if ctx.Err() == nil {
+			loge.Errorf(ctx, "%v find peers of %v failed: %v", set.source, ns, err)
+		}
+
+		chPoll := time.After(interval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-chPoll:
+				break wait
+			case pi, ok := <-chNotified:
+				if !ok {
+					// resubscribed on the next poll
+					chNotified = nil
+					continue
+				}
+				if addFoundPeer(h, pi) {
+					set.add(pi.ID)
+				}
+			}
+		}
+	}
+}
+
+// addFoundPeer adds the addresses of pi to the peerstore, it returns false if pi is h itself.
+func addFoundPeer(h host.Host, pi peer.AddrInfo) bool {
+	if pi.ID == h.ID() || pi.ID == "" {
+		return false
+	}
+	if len(pi.Addrs) > 0 {
+		h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.ProviderAddrTTL)
+	}
+	return true
+}
+
+// pollNamespaces polls d for each of the namespaces together.
+func pollNamespaces(ctx context.Context, h host.Host, d coreDiscovery.Discoverer, namespaces []string,
+	interval time.Duration, source string, emit func(Event)) {
+	var wg sync.WaitGroup
+	for _, ns := range namespaces {
+		wg.Add(1)
+		go func(ns string) {
+			defer wg.Done()
+			pollDiscovery(ctx, h, d, ns, interval, newPeerSet(source, ns, emit))
+		}(ns)
+	}
+	wg.Wait()
+}
+
+// mergeNamespaces returns ns followed by the namespaces which are not ns, without duplicates.
+// The empty namespace is only kept if there is no other.
+func mergeNamespaces(ns string, namespaces []string) []string {
+	merged := make([]string, 0, len(namespaces)+1)
+	seen := make(map[string]bool)
+	for _, n := range append([]string{ns}, namespaces...) {
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		merged = append(merged, n)
+	}
+	if len(merged) == 0 {
+		merged = append(merged, "")
+	}
+	return merged
+}
+
+// DHTDiscoverer advertises the host under Namespace and Namespaces on the kademlia DHT and
+// looks up the other peers advertised there every Interval.
+type DHTDiscoverer struct {
+	// BootstrapPeers are the multiaddrs of the bootstrap nodes, the public libp2p nodes are
+	// used if it is nil
+	BootstrapPeers []string
+	Namespace      string
+	Namespaces     []string
+	Interval       time.Duration
+}
+
+func (d *DHTDiscoverer) Name() string {
+	return "dht"
+}
+
+func (d *DHTDiscoverer) Run(ctx context.Context, h host.Host, emit func(Event)) error {
+	namespaces := mergeNamespaces(d.Namespace, d.Namespaces)
+	kademliaDHT, routingDiscovery, err := doBootstrap(ctx, h, d.BootstrapPeers, namespaces)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = kademliaDHT.Close()
+	}()
+	pollNamespaces(ctx, h, routingDiscovery, namespaces, d.Interval, d.Name(), emit)
+	return nil
+}
+
+// RendezvousDiscoverer advertises the host on a libp2p Discovery, built by NewDiscovery if
+// Discovery is nil, and looks up the peers of its namespaces every Interval. The peers are
+// reported as soon as they register if the Discovery is a Subscriber.
+type RendezvousDiscoverer struct {
+	Discovery    coreDiscovery.Discovery
+	NewDiscovery func(h host.Host) (coreDiscovery.Discovery, error)
+	Namespace    string
+	Namespaces   []string
+	Interval     time.Duration
+	// SourceName is the Name of the discoverer, "rendezvous" if it is empty
+	SourceName string
+}
+
+func (d *RendezvousDiscoverer) Name() string {
+	if d.SourceName != "" {
+		return d.SourceName
+	}
+	return "rendezvous"
+}
+
+func (d *RendezvousDiscoverer) Run(ctx context.Context, h host.Host, emit func(Event)) error {
+	disc := d.Discovery
+	if disc == nil {
+		if d.NewDiscovery == nil {
+			return errors.New("no discovery")
+		}
+		var err error
+		if disc, err = d.NewDiscovery(h); err != nil {
+			return err
+		}
+	}
+	namespaces := mergeNamespaces(d.Namespace, d.Namespaces)
+	for _, ns := range namespaces {
+		discovery.Advertise(ctx, disc, ns)
+	}
+
+	pollNamespaces(ctx, h, disc, namespaces, d.Interval, d.Name(), emit)
+	return nil
+}
+
+// StaticDiscoverer reports a fixed list of peers, Addrs are multiaddrs ending with /p2p/<id>.
+type StaticDiscoverer struct {
+	Addrs []string
+}
+
+func (d *StaticDiscoverer) Name() string {
+	return "static"
+}
+
+func (d *StaticDiscoverer) Run(ctx context.Context, h host.Host, emit func(Event)) error {
+	set := newPeerSet(d.Name(), "", emit)
+	for _, addr := range d.Addrs {
+		pi, err := addrInfoFromString(addr)
+		if err != nil {
+			loge.Errorf(ctx, "static peer %v invalid: %v", addr, err)
+			continue
+		}
+		if pi.ID == h.ID() {
+			continue
+		}
+		h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+		set.add(pi.ID)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func addrInfoFromString(addr string) (*peer.AddrInfo, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return peer.AddrInfoFromP2pAddr(ma)
+}
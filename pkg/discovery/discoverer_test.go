@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coreDiscovery "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sgostarter/libp2p/pkg/bootstrap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newPeerTracker(time.Minute)
+
+	assert.True(t, tracker.onEvent(Event{PeerID: "a", Source: "dht"}, now))
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "dht"}, now))
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "mdns"}, now))
+	assert.False(t, tracker.onEvent(Event{PeerID: "b", Source: "dht", Lost: true}, now))
+
+	// a flaky source misses the peer for a while
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "dht", Lost: true}, now))
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "mdns", Lost: true}, now))
+	assert.Empty(t, tracker.expire(now.Add(30*time.Second)))
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "dht"}, now.Add(40*time.Second)))
+	assert.Empty(t, tracker.expire(now.Add(5*time.Minute)))
+
+	lostAt := now.Add(6 * time.Minute)
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "dht", Lost: true}, lostAt))
+	assert.Empty(t, tracker.expire(lostAt.Add(59*time.Second)))
+	assert.Equal(t, []Event{{PeerID: "a", Source: "dht", Lost: true, LastSeen: lostAt}},
+		tracker.expire(lostAt.Add(time.Minute)))
+	assert.Empty(t, tracker.peers)
+
+	assert.True(t, tracker.onEvent(Event{PeerID: "a", Source: "mdns"}, lostAt.Add(2*time.Minute)))
+
+	// a peer is tracked in each of its namespaces
+	assert.True(t, tracker.onEvent(Event{PeerID: "a", Source: "dht", Namespace: "eu"}, now))
+	assert.True(t, tracker.onEvent(Event{PeerID: "a", Source: "dht", Namespace: "us"}, now))
+	assert.False(t, tracker.onEvent(Event{PeerID: "a", Source: "dht", Namespace: "us", Lost: true}, now))
+	assert.Equal(t, []Event{{PeerID: "a", Source: "dht", Namespace: "us", Lost: true, LastSeen: now}},
+		tracker.expire(now.Add(time.Minute)))
+}
+
+func TestMergeNamespaces(t *testing.T) {
+	assert.Equal(t, []string{""}, mergeNamespaces("", nil))
+	assert.Equal(t, []string{"a"}, mergeNamespaces("a", nil))
+	assert.Equal(t, []string{"a", "b", "c"}, mergeNamespaces("a", []string{"b", "a", "", "c", "b"}))
+	assert.Equal(t, []string{"b"}, mergeNamespaces("", []string{"b"}))
+}
+
+func TestPeerSet(t *testing.T) {
+	var events []Event
+	set := newPeerSet("file", "", func(ev Event) {
+		events = append(events, ev)
+	})
+
+	set.update(map[peer.ID]bool{"a": true, "b": true})
+	assert.Len(t, events, 2)
+
+	events = nil
+	set.update(map[peer.ID]bool{"b": true, "c": true})
+	assert.ElementsMatch(t, []Event{
+		{PeerID: peer.ID("a").Pretty(), Source: "file", Lost: true},
+		{PeerID: peer.ID("c").Pretty(), Source: "file"},
+	}, events)
+}
+
+// testSubscriber always finds peer a and notifies the peers sent to chNotified.
+type testSubscriber struct {
+	chNotified chan peer.AddrInfo
+}
+
+func (d *testSubscriber) FindPeers(ctx context.Context, ns string, opts ...coreDiscovery.Option) (<-chan peer.AddrInfo, error) {
+	ch := make(chan peer.AddrInfo, 1)
+	ch <- peer.AddrInfo{ID: "a"}
+	close(ch)
+	return ch, nil
+}
+
+func (d *testSubscriber) Subscribe(ctx context.Context, ns string) (<-chan peer.AddrInfo, error) {
+	return d.chNotified, nil
+}
+
+func TestPollDiscoverySubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := bootstrap.NewHost(ctx, &bootstrap.HostParam{})
+	assert.Nil(t, err)
+	defer func() {
+		_ = h.Close()
+	}()
+
+	d := &testSubscriber{chNotified: make(chan peer.AddrInfo)}
+	chEvents := make(chan Event, 10)
+	chDone := make(chan interface{})
+	go func() {
+		defer close(chDone)
+		pollDiscovery(ctx, h, d, "ns", time.Hour, newPeerSet("rendezvous", "ns", func(ev Event) {
+			chEvents <- ev
+		}))
+	}()
+
+	// the peer notified is reported without waiting for the next poll
+	assert.Equal(t, peer.ID("a").Pretty(), (<-chEvents).PeerID)
+	d.chNotified <- peer.AddrInfo{ID: h.ID()}
+	d.chNotified <- peer.AddrInfo{ID: "b"}
+	select {
+	case ev := <-chEvents:
+		assert.Equal(t, Event{PeerID: peer.ID("b").Pretty(), Source: "rendezvous", Namespace: "ns"}, ev)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "notified peer not reported")
+	}
+
+	cancel()
+	<-chDone
+}
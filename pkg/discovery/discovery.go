@@ -9,6 +9,7 @@ import (
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
 	"github.com/libp2p/go-libp2p"
 	relay "github.com/libp2p/go-libp2p-circuit"
+	coreDiscovery "github.com/libp2p/go-libp2p-core/discovery"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -20,12 +21,16 @@ import (
 	"github.com/sgostarter/libp2p/pkg/p2pio"
 )
 
+// Observer is told about the host, its inbound streams and the peers the Discoverers find.
 type Observer interface {
 	NewHost(h interface{}, hID string)
 	StreamTalk(peerID string, rw *p2pio.ReadWriteCloser, chExit chan interface{})
-	OnNewPeerStart()
-	OnNewPeer(peerID string)
-	OnNewPeerFinish()
+	// OnPeerFound is called when the first Discoverer reports a peer in a namespace, the
+	// Source of ev is that Discoverer
+	OnPeerFound(ev Event)
+	// OnPeerLost is called when no Discoverer has reported a peer in a namespace for the
+	// LostGracePeriod, the Source of ev is the last Discoverer which lost it
+	OnPeerLost(ev Event)
 }
 
 type ServerParam struct {
@@ -34,18 +39,49 @@ type ServerParam struct {
 	BootstrapPeers   []string
 	AdvertiseNS      string
 	MinCheckInterval time.Duration
+	// AdvertiseNamespaces are advertised and searched together with AdvertiseNS
+	AdvertiseNamespaces []string
+	// LostGracePeriod is how long a peer no Discoverer reports any more is kept before it is
+	// lost, 1 minute if <= 0
+	LostGracePeriod time.Duration
+	// StreamFilter rejects the inbound streams it returns an error for, remoteAddr is the
+	// multiaddr of the remote end
+	StreamFilter func(peerID, remoteAddr string) error
+	// DisableDHT runs the host without DHT discovery, peers are only known by other means
+	DisableDHT bool
+	// EnableMDNS finds the peers of the local network by mDNS, together with the DHT ones
+	// unless DisableDHT is set. MDNSServiceTag isolates the nodes of a network, the libp2p
+	// default tag is used if it is empty. MDNSInterval is 10 seconds if <= 0.
+	EnableMDNS     bool
+	MDNSServiceTag string
+	MDNSInterval   time.Duration
+	// RendezvousPoints are the multiaddrs of the bootstrap nodes which run a rendezvous point,
+	// the host is advertised under the namespaces on each of them, see bootstrap.RendezvousClient
+	RendezvousPoints []string
+	// Discoverers are the sources of peers, they replace the DHT, mDNS and rendezvous options
+	// above if not empty
+	Discoverers []Discoverer
 }
 
+// newDHT builds the kademlia DHT of h. dht.New panics if its context is done while it is
+// being built, so the DHT lives on its own context and is released by its Close.
+func newDHT(h host.Host) (*dht.IpfsDHT, error) {
+	return dht.New(context.Background(), h, dht.Mode(dht.ModeAutoServer))
+}
+
+// doBootstrap connects the DHT to the bootstrap peers and advertises the host under the
+// namespaces, the DHT must be closed by the caller.
 func doBootstrap(ctx context.Context, h host.Host, bootstrapPeers []string,
-	advertiseNS string) (*discovery.RoutingDiscovery, error) {
-	kademliaDHT, err := dht.New(ctx, h, dht.Mode(dht.ModeAutoServer))
+	namespaces []string) (*dht.IpfsDHT, *discovery.RoutingDiscovery, error) {
+	kademliaDHT, err := newDHT(h)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	err = kademliaDHT.Bootstrap(ctx)
 	if err != nil {
-		return nil, err
+		_ = kademliaDHT.Close()
+		return nil, nil, err
 	}
 
 	bootstrapAddress := make([]multiaddr.Multiaddr, 0)
@@ -56,7 +92,8 @@ func doBootstrap(ctx context.Context, h host.Host, bootstrapPeers []string,
 			ma, err := multiaddr.NewMultiaddr(bootstrapPeer)
 			if err != nil {
 				loge.Errorf(nil, "addr convert failed: %v", err)
-				return nil, err
+				_ = kademliaDHT.Close()
+				return nil, nil, err
 			}
 			bootstrapAddress = append(bootstrapAddress, ma)
 		}
@@ -82,9 +119,11 @@ func doBootstrap(ctx context.Context, h host.Host, bootstrapPeers []string,
 	wg.Wait()
 
 	routingDiscovery := discovery.NewRoutingDiscovery(kademliaDHT)
-	discovery.Advertise(ctx, routingDiscovery, advertiseNS)
+	for _, ns := range namespaces {
+		discovery.Advertise(ctx, routingDiscovery, ns)
+	}
 
-	return routingDiscovery, nil
+	return kademliaDHT, routingDiscovery, nil
 }
 
 func RunServer(ctx context.Context, param ServerParam, ob Observer) error {
@@ -94,7 +133,7 @@ func RunServer(ctx context.Context, param ServerParam, ob Observer) error {
 
 	h, err := bootstrap.NewHost(ctx, &param.HostParam, libp2p.EnableRelay(relay.OptHop))
 	if err != nil {
-		return nil
+		return err
 	}
 	defer func() {
 		_ = h.Close()
@@ -105,47 +144,97 @@ func RunServer(ctx context.Context, param ServerParam, ob Observer) error {
 		defer func() {
 			_ = stream.Close()
 		}()
+		peerID := stream.Conn().RemotePeer().Pretty()
+		if param.StreamFilter != nil {
+			if err := param.StreamFilter(peerID, stream.Conn().RemoteMultiaddr().String()); err != nil {
+				loge.Warnf(ctx, "stream from %v rejected: %v", peerID, err)
+				_ = stream.Reset()
+				return
+			}
+		}
 		chExit := make(chan interface{})
-		ob.StreamTalk(stream.Conn().RemotePeer().Pretty(), p2pio.NewReadWriteCloser(stream), chExit)
+		ob.StreamTalk(peerID, p2pio.NewReadWriteCloser(stream), chExit)
 		<-chExit
 	})
 
-	routingDiscovery, err := doBootstrap(ctx, h, param.BootstrapPeers, param.AdvertiseNS)
-	if err != nil {
-		return err
+	discoverers := param.Discoverers
+	if len(discoverers) == 0 {
+		discoverers = legacyDiscoverers(&param)
+	}
+
+	chEvent := make(chan Event, 16)
+	emit := func(ev Event) {
+		select {
+		case chEvent <- ev:
+		case <-ctx.Done():
+		}
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, d := range discoverers {
+		wg.Add(1)
+		go func(d Discoverer) {
+			defer wg.Done()
+			if err := d.Run(ctx, h, emit); err != nil && ctx.Err() == nil {
+				loge.Errorf(ctx, "discoverer %v failed: %v", d.Name(), err)
+			}
+		}(d)
 	}
 
-	timeNow := time.Now()
 	minCheckInterval := param.MinCheckInterval
 	if minCheckInterval <= 0 {
 		minCheckInterval = 5 * time.Second
 	}
-	var quit bool
-	for !quit {
-		if time.Since(timeNow) <= minCheckInterval {
-			time.Sleep(minCheckInterval)
-			timeNow = time.Now()
-		}
-		peerChan, err := routingDiscovery.FindPeers(ctx, param.AdvertiseNS)
-		if err != nil {
-			loge.Errorf(ctx, "find peers failed: %v", err)
-			continue
-		}
-
-		ob.OnNewPeerStart()
-		for p := range peerChan {
-			if p.ID == h.ID() {
-				continue
-			}
-			ob.OnNewPeer(p.ID.Pretty())
-		}
-		ob.OnNewPeerFinish()
+	ticker := time.NewTicker(minCheckInterval)
+	defer ticker.Stop()
 
+	tracker := newPeerTracker(param.LostGracePeriod)
+	for {
 		select {
 		case <-ctx.Done():
-			quit = true
-		default:
+			return nil
+		case ev := <-chEvent:
+			now := time.Now()
+			if tracker.onEvent(ev, now) {
+				ev.LastSeen = now
+				ob.OnPeerFound(ev)
+			}
+		case now := <-ticker.C:
+			for _, ev := range tracker.expire(now) {
+				ob.OnPeerLost(ev)
+			}
 		}
 	}
-	return nil
+}
+
+// legacyDiscoverers builds the discoverers of the DHT, mDNS and rendezvous options of param.
+func legacyDiscoverers(param *ServerParam) []Discoverer {
+	var discoverers []Discoverer
+	if !param.DisableDHT {
+		discoverers = append(discoverers, &DHTDiscoverer{
+			BootstrapPeers: param.BootstrapPeers,
+			Namespace:      param.AdvertiseNS,
+			Namespaces:     param.AdvertiseNamespaces,
+			Interval:       param.MinCheckInterval,
+		})
+	}
+	if param.EnableMDNS {
+		discoverers = append(discoverers, &MDNSDiscoverer{
+			ServiceTag: param.MDNSServiceTag,
+			Interval:   param.MDNSInterval,
+		})
+	}
+	for _, addr := range param.RendezvousPoints {
+		addr := addr
+		discoverers = append(discoverers, &RendezvousDiscoverer{
+			NewDiscovery: func(h host.Host) (coreDiscovery.Discovery, error) {
+				return bootstrap.NewRendezvousClient(h, addr)
+			},
+			Namespace:  param.AdvertiseNS,
+			Namespaces: param.AdvertiseNamespaces,
+			Interval:   param.MinCheckInterval,
+			SourceName: "rendezvous " + addr,
+		})
+	}
+	return discoverers
 }
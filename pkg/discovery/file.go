@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// FileDiscoverer reports the peers listed in the file at Path, one multiaddr ending with
+// /p2p/<id> per line, blank lines and lines starting with # are skipped. The file is checked
+// every Interval, the peers removed from it are lost.
+type FileDiscoverer struct {
+	Path     string
+	Interval time.Duration
+}
+
+func (d *FileDiscoverer) Name() string {
+	return "file"
+}
+
+func (d *FileDiscoverer) Run(ctx context.Context, h host.Host, emit func(Event)) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	set := newPeerSet(d.Name(), "", emit)
+
+	var listed []*peer.AddrInfo
+	var modTime time.Time
+	var size int64 = -1
+	for {
+		fi, err := os.Stat(d.Path)
+		switch {
+		case err != nil:
+			loge.Errorf(ctx, "peers file %v: %v", d.Path, err)
+		case fi.ModTime().Equal(modTime) && fi.Size() == size:
+		default:
+			infos, err := readPeersFile(d.Path)
+			if err != nil {
+				loge.Errorf(ctx, "peers file %v: %v", d.Path, err)
+				break
+			}
+			modTime, size, listed = fi.ModTime(), fi.Size(), infos
+		}
+
+		// the addresses are refreshed on every check and expire a while after the peer is
+		// removed from the file
+		ids := make(map[peer.ID]bool)
+		for _, pi := range listed {
+			if pi.ID == h.ID() {
+				continue
+			}
+			h.Peerstore().AddAddrs(pi.ID, pi.Addrs, 3*interval)
+			ids[pi.ID] = true
+		}
+		set.update(ids)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func readPeersFile(path string) ([]*peer.AddrInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var infos []*peer.AddrInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pi, err := addrInfoFromString(line)
+		if err != nil {
+			loge.Errorf(nil, "peers file %v: invalid line %q: %v", path, line, err)
+			continue
+		}
+		infos = append(infos, pi)
+	}
+	return infos, scanner.Err()
+}
@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mdns "github.com/libp2p/go-libp2p/p2p/discovery"
+)
+
+const (
+	defaultMDNSInterval = 10 * time.Second
+	// mdnsQueryTimeout is how long a query of the libp2p mDNS service lasts, the next one is
+	// not sent before
+	mdnsQueryTimeout = 5 * time.Second
+)
+
+// MDNSDiscoverer finds the peers of the local network by mDNS, a peer not answering for three
+// queries is lost. ServiceTag isolates the nodes of a network, the libp2p default tag
+// is used if it is empty. Interval is 10 seconds if <= 0.
+type MDNSDiscoverer struct {
+	ServiceTag string
+	Interval   time.Duration
+}
+
+func (d *MDNSDiscoverer) Name() string {
+	return "mdns"
+}
+
+func (d *MDNSDiscoverer) Run(ctx context.Context, h host.Host, emit func(Event)) error {
+	serviceTag := d.ServiceTag
+	if serviceTag == "" {
+		serviceTag = mdns.ServiceTag
+	}
+	interval := d.Interval
+	if interval <= 0 {
+		interval = defaultMDNSInterval
+	}
+
+	service, err := mdns.NewMdnsService(ctx, h, interval, serviceTag)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = service.Close()
+	}()
+
+	peers := &mdnsPeers{
+		h:        h,
+		ttl:      3 * (interval + mdnsQueryTimeout),
+		set:      newPeerSet(d.Name(), "", emit),
+		lastSeen: make(map[peer.ID]time.Time),
+	}
+	service.RegisterNotifee(peers)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			peers.expire()
+		}
+	}
+}
+
+// mdnsPeers collects the peers mDNS finds on the local network.
+type mdnsPeers struct {
+	h   host.Host
+	ttl time.Duration
+
+	lock     sync.Mutex
+	set      *peerSet
+	lastSeen map[peer.ID]time.Time
+}
+
+// HandlePeerFound implements the Notifee of the mDNS service.
+func (peers *mdnsPeers) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == peers.h.ID() {
+		return
+	}
+	peers.h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peers.ttl)
+
+	peers.lock.Lock()
+	defer peers.lock.Unlock()
+
+	if _, ok := peers.lastSeen[pi.ID]; !ok {
+		loge.Infof(nil, "mdns found peer %v", pi.ID.Pretty())
+	}
+	peers.lastSeen[pi.ID] = time.Now()
+	peers.set.add(pi.ID)
+}
+
+// expire loses the peers which did not answer for ttl.
+func (peers *mdnsPeers) expire() {
+	peers.lock.Lock()
+	defer peers.lock.Unlock()
+
+	for id, lastSeen := range peers.lastSeen {
+		if time.Since(lastSeen) > peers.ttl {
+			delete(peers.lastSeen, id)
+			peers.set.remove(id)
+		}
+	}
+}
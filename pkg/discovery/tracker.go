@@ -0,0 +1,85 @@
+package discovery
+
+import "time"
+
+const defaultLostGracePeriod = time.Minute
+
+type trackedPeer struct {
+	sources  map[string]bool
+	lastSeen time.Time
+	// lostBy is the last source which lost the peer
+	lostBy string
+}
+
+// trackedKey is a peer in a namespace, a peer found in several namespaces is tracked in each.
+type trackedKey struct {
+	peerID    string
+	namespace string
+}
+
+// peerTracker merges the Events of the Discoverers into one peer set. A peer is found in a
+// namespace when its first source reports it there, and lost only when no source has reported
+// it there for the grace period, so a peer briefly missed by a flaky backend is not lost at all.
+type peerTracker struct {
+	grace time.Duration
+	peers map[trackedKey]*trackedPeer
+}
+
+func newPeerTracker(grace time.Duration) *peerTracker {
+	if grace <= 0 {
+		grace = defaultLostGracePeriod
+	}
+	return &peerTracker{
+		grace: grace,
+		peers: make(map[trackedKey]*trackedPeer),
+	}
+}
+
+// onEvent applies ev and returns whether the peer of ev is newly found in its namespace.
+func (tracker *peerTracker) onEvent(ev Event, now time.Time) bool {
+	key := trackedKey{peerID: ev.PeerID, namespace: ev.Namespace}
+	p, ok := tracker.peers[key]
+	if ev.Lost {
+		if !ok || !p.sources[ev.Source] {
+			return false
+		}
+		delete(p.sources, ev.Source)
+		p.lastSeen = now
+		p.lostBy = ev.Source
+		return false
+	}
+
+	if !ok {
+		p = &trackedPeer{
+			sources: make(map[string]bool),
+		}
+		tracker.peers[key] = p
+	}
+	p.sources[ev.Source] = true
+	p.lastSeen = now
+	return !ok
+}
+
+// expire removes and returns the peers no source has reported in a namespace for the grace
+// period.
+func (tracker *peerTracker) expire(now time.Time) []Event {
+	var lost []Event
+	for key, p := range tracker.peers {
+		if len(p.sources) > 0 {
+			p.lastSeen = now
+			continue
+		}
+		if now.Sub(p.lastSeen) < tracker.grace {
+			continue
+		}
+		delete(tracker.peers, key)
+		lost = append(lost, Event{
+			PeerID:    key.peerID,
+			Source:    p.lostBy,
+			Namespace: key.namespace,
+			Lost:      true,
+			LastSeen:  p.lastSeen,
+		})
+	}
+	return lost
+}
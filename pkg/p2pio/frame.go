@@ -0,0 +1,64 @@
+package p2pio
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// DefaultMaxFrameSize is used by ReadFrame when maxSize <= 0.
+const DefaultMaxFrameSize = 4 << 20
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+type byteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.Reader, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// AppendFrame appends data to dst prefixed by its varint encoded length.
+func AppendFrame(dst, data []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	dst = append(dst, lenBuf[:n]...)
+	return append(dst, data...)
+}
+
+func WriteFrame(w io.Writer, data []byte) error {
+	_, err := w.Write(AppendFrame(nil, data))
+	return err
+}
+
+// ReadFrame reads one frame written by WriteFrame, frames larger than maxSize are rejected
+// with ErrFrameTooLarge before their body is read.
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{Reader: r}
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,39 @@
+package p2pio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, WriteFrame(&buf, []byte("hello")))
+	assert.Nil(t, WriteFrame(&buf, nil))
+	assert.Nil(t, WriteFrame(&buf, bytes.Repeat([]byte("x"), 1000)))
+
+	r := iotest.OneByteReader(&buf)
+	d, err := ReadFrame(r, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(d))
+	d, err = ReadFrame(r, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, d)
+	d, err = ReadFrame(r, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(d))
+	_, err = ReadFrame(r, 0)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	d := AppendFrame(nil, bytes.Repeat([]byte("x"), 100))
+	_, err := ReadFrame(bytes.NewReader(d), 99)
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	_, err = ReadFrame(bytes.NewReader(d[:50]), 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
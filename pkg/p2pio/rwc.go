@@ -2,6 +2,7 @@ package p2pio
 
 import (
 	"bufio"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 )
@@ -22,3 +23,13 @@ func NewReadWriteCloser(s network.Stream) *ReadWriteCloser {
 func (rwc *ReadWriteCloser) Close() error {
 	return rwc.s.Close()
 }
+
+// SetWriteDeadline bounds the writes to the stream, the zero time removes the deadline.
+func (rwc *ReadWriteCloser) SetWriteDeadline(t time.Time) error {
+	return rwc.s.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the multiaddr of the remote end of the stream.
+func (rwc *ReadWriteCloser) RemoteAddr() string {
+	return rwc.s.Conn().RemoteMultiaddr().String()
+}
@@ -1,6 +1,11 @@
 package peer
 
-import "time"
+import (
+	"time"
+
+	"github.com/sgostarter/libp2p/pkg/acl"
+	"github.com/sgostarter/libp2p/pkg/discovery"
+)
 
 type P2PConfig struct {
 	AdvertiseNameSpace string
@@ -8,8 +13,89 @@ type P2PConfig struct {
 	ProtocolID         string
 	ListenPort         int
 	MaxConnectedPeers  int
+	// AdvertiseNameSpaces are advertised and searched together with AdvertiseNameSpace, the
+	// peers are tagged by the namespaces they are found in, see PeerInfo.Namespaces
+	AdvertiseNameSpaces []string
 
+	// KeepAliveDuration is the time a peer may stay silent before it is dead, 10 minutes if <= 0,
+	// it derives the KeepAlive fields left zero
 	KeepAliveDuration time.Duration
+	KeepAlive         KeepAlivePolicy
+	SendQueue         SendQueuePolicy
+	Reconnect         ReconnectPolicy
+	// StickyPeers are the IDs of peers kept connected, see PeersProxy.AddStickyPeer
+	StickyPeers []string
+	// StaticPeers are the full multiaddrs (/ip4/.../tcp/.../p2p/<peer id>) of peers dialed at
+	// startup and kept connected like sticky peers, whatever discovery finds
+	StaticPeers []string
+	// DisableDHT turns the DHT discovery off, for deployments which only know StaticPeers
+	// or the local network
+	DisableDHT bool
+	// EnableMDNS finds the peers of the local network by mDNS, see discovery.ServerParam
+	EnableMDNS     bool
+	MDNSServiceTag string
+	// RendezvousPoints are the multiaddrs of the bootstrap nodes running a rendezvous point,
+	// together with DisableDHT they replace the DHT discovery
+	RendezvousPoints []string
+	// Discoverers are the sources of peers, they replace the DHT, mDNS and rendezvous options
+	// above if not empty, see discovery.Discoverer
+	Discoverers []discovery.Discoverer
+	// PeerLostGracePeriod is how long a peer the discoverers miss is kept before it is lost,
+	// see discovery.ServerParam. The connected peers are not dropped when they are lost.
+	PeerLostGracePeriod time.Duration
+	// ACL filters the inbound streams and the outbound connections, it may be changed at
+	// runtime. Nil allows every peer.
+	ACL *acl.ACL
+	// Score disconnects and bans the misbehaving peers if Score.Enabled, scoring is off by default
+	Score ScorePolicy
+	// RateLimit limits the inbound messages, unlimited by default
+	RateLimit RateLimitPolicy
+	// CallTimeout bounds the PeersProxy.Call without a context deadline, 30 seconds if <= 0
+	CallTimeout time.Duration
+	// WriteTimeout bounds the write of a message to a peer, which is closed if it is exceeded,
+	// 30 seconds if <= 0
+	WriteTimeout time.Duration
+
+	// SeenCacheSize and SeenCacheTTL bound the gossip deduplication cache, a message ID is
+	// forgotten after SeenCacheTTL without being seen or when the cache is full
+	SeenCacheSize int
+	SeenCacheTTL  time.Duration
+
+	// GossipMaxHops stops relaying a gossiped message after that many hops, 8 if <= 0
+	GossipMaxHops int
+	// GossipFanout is the count of peers a gossiped message is pushed to, the other peers only
+	// get an IHAVE announcement and Send reports them with ErrAnnounced, 0 pushes to all peers. The peers are picked at random, the
+	// ones with a lower RTT are more likely to be picked.
+	GossipFanout int
+	// GossipHistorySize and GossipHistoryTTL bound the announced messages kept for IWANT
+	GossipHistorySize int
+	GossipHistoryTTL  time.Duration
+}
+
+// KeepAlivePolicy controls the ping/pong exchange which detects dead peers.
+type KeepAlivePolicy struct {
+	// PingInterval is the period of the pings, KeepAliveDuration/3 if <= 0
+	PingInterval time.Duration
+	// PongTimeout is how long a ping waits for its pong before it counts as missed, PingInterval if <= 0
+	PongTimeout time.Duration
+	// MaxMissedPongs is how many pongs in a row may be missed, the peer is dead on the next miss, 2 if <= 0
+	MaxMissedPongs int
+}
+
+func (policy KeepAlivePolicy) withDefaults(keepAliveDuration time.Duration) KeepAlivePolicy {
+	if keepAliveDuration <= 0 {
+		keepAliveDuration = 10 * time.Minute
+	}
+	if policy.PingInterval <= 0 {
+		policy.PingInterval = keepAliveDuration / 3
+	}
+	if policy.PongTimeout <= 0 {
+		policy.PongTimeout = policy.PingInterval
+	}
+	if policy.MaxMissedPongs <= 0 {
+		policy.MaxMissedPongs = 2
+	}
+	return policy
 }
 
 type MessageConfig struct {
@@ -0,0 +1,31 @@
+package peer
+
+import (
+	"errors"
+
+	"github.com/sgostarter/libp2p/pkg/acl"
+)
+
+var (
+	ErrClosed            = errors.New("peers proxy closed")
+	ErrNoPeerID          = errors.New("no peer id")
+	ErrPeerUnreachable   = errors.New("peer unreachable")
+	ErrTimeout           = errors.New("timeout")
+	ErrDuplicateCall     = errors.New("duplicate call id")
+	ErrPeerClosed        = errors.New("peer closed")
+	ErrNoPeers           = errors.New("no connected peers")
+	ErrNotSupported      = errors.New("not supported by the message helper")
+	ErrInvalidTopic      = errors.New("invalid topic")
+	ErrAlreadySubscribed = errors.New("topic already subscribed")
+	ErrPeerReplaced      = errors.New("peer replaced by a new stream")
+	ErrKeepAliveTimeout  = errors.New("keep alive timeout")
+	ErrSendQueueFull     = errors.New("send queue full")
+	ErrWriteFailed       = errors.New("write to peer failed")
+	ErrWriteTimeout      = errors.New("write to peer timeout")
+	ErrPeerDenied        = acl.ErrDenied
+	ErrPeerBanned        = errors.New("peer banned")
+	ErrPeerScoreLow      = errors.New("peer score too low")
+	ErrRateLimited       = errors.New("peer over rate limit")
+	// ErrAnnounced reports a peer a gossiped message was only announced to with IHAVE
+	ErrAnnounced = errors.New("message only announced")
+)
@@ -1,6 +1,9 @@
 package peer
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type Message interface {
 	Bytes() []byte
@@ -19,3 +22,72 @@ type MessageHelper interface {
 	IsPingMessage(message Message) bool
 	IsPongMessage(message Message) bool
 }
+
+// KeepAliveMessage is implemented by the ping and pong messages of MessageHelpers which stamp
+// them with a nonce and the ping's send time, a pong echoes both from its ping. PeerProxy matches
+// pongs to pings with the nonce to measure the round trip time, without it any pong answers the
+// latest ping.
+type KeepAliveMessage interface {
+	Message
+	KeepAliveNonce() uint64
+	KeepAliveTimestamp() time.Time
+}
+
+// ResponseMessage is a Message which answers a request sent by PeersProxy.Call,
+// ReplyTo returns the ID of that request.
+type ResponseMessage interface {
+	Message
+	ReplyTo() string
+}
+
+// DeliveryCallback reports the delivery result of a message for one target peer, err is nil once
+// the message has been written to the peer's stream. It is called from the peer's routine and must
+// not block.
+type DeliveryCallback func(peerID string, err error)
+
+// HostAwareMessageHelper is implemented by MessageHelpers which stamp the local host ID on the
+// messages they create, PeersProxy calls SetHostID once the host is up.
+type HostAwareMessageHelper interface {
+	SetHostID(hostID string)
+}
+
+// MessageMeta is the routing data PeersProxy attaches to application messages.
+type MessageMeta struct {
+	Topic string
+	// Hops counts the relays a gossiped message went through
+	Hops int
+}
+
+// MetaMessageHelper is implemented by MessageHelpers whose messages can carry a MessageMeta,
+// topic publishing needs it.
+type MetaMessageHelper interface {
+	GetMessageMeta(msg Message) MessageMeta
+	// SetMessageMeta returns a copy of msg carrying meta.
+	SetMessageMeta(msg Message, meta MessageMeta) (Message, error)
+}
+
+type ControlKind int
+
+const (
+	// ControlSubscriptions carries the complete topic set the sender subscribes to.
+	ControlSubscriptions ControlKind = iota + 1
+	// ControlIHave announces the IDs of gossiped messages the sender holds.
+	ControlIHave
+	// ControlIWant asks for the announced messages the sender has not seen.
+	ControlIWant
+)
+
+// Control is a message PeersProxy exchanges with its peers, it is never delivered to the application.
+type Control struct {
+	Kind   ControlKind
+	Topics []string
+	IDs    []string
+}
+
+// ControlMessageHelper is implemented by MessageHelpers which can carry Control messages,
+// topic subscriptions need it.
+type ControlMessageHelper interface {
+	CreateControlMessage(ctrl *Control) (Message, error)
+	// ParseControlMessage returns nil if msg is not a control message.
+	ParseControlMessage(msg Message) *Control
+}
@@ -0,0 +1,451 @@
+package peer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// field numbers and kinds of envelope.proto
+const (
+	envelopeFieldKind    protowire.Number = 1
+	envelopeFieldID      protowire.Number = 2
+	envelopeFieldGossip  protowire.Number = 3
+	envelopeFieldSender  protowire.Number = 4
+	envelopeFieldReplyTo protowire.Number = 5
+	envelopeFieldPayload protowire.Number = 6
+	envelopeFieldTopic   protowire.Number = 7
+	envelopeFieldControl protowire.Number = 8
+	envelopeFieldHops    protowire.Number = 9
+	envelopeFieldNonce   protowire.Number = 10
+	envelopeFieldPingAt  protowire.Number = 11
+
+	envelopeKindData    = 0
+	envelopeKindPing    = 1
+	envelopeKindPong    = 2
+	envelopeKindControl = 3
+
+	controlFieldKind   protowire.Number = 1
+	controlFieldTopics protowire.Number = 2
+	controlFieldIDs    protowire.Number = 3
+)
+
+// ProtoMessage is the Message created and read by ProtoMessageHelper.
+type ProtoMessage struct {
+	kind    uint64
+	id      string
+	gossip  bool
+	sender  string
+	replyTo string
+	topic   string
+	hops    uint64
+	nonce   uint64
+	pingAt  int64
+	payload proto.Message
+	any     *anypb.Any
+	control *Control
+	data    []byte
+	// priority is local to this node, it is not sent
+	priority Priority
+}
+
+func (msg *ProtoMessage) Bytes() []byte {
+	return msg.data
+}
+
+// Priority implements PriorityMessage.
+func (msg *ProtoMessage) Priority() Priority {
+	return msg.priority
+}
+
+// SetPriority sets the priority the message is queued with, it returns msg.
+func (msg *ProtoMessage) SetPriority(priority Priority) *ProtoMessage {
+	msg.priority = priority
+	return msg
+}
+
+func (msg *ProtoMessage) ID() string {
+	return msg.id
+}
+
+func (msg *ProtoMessage) GossipFlag() bool {
+	return msg.gossip
+}
+
+func (msg *ProtoMessage) ReplyTo() string {
+	return msg.replyTo
+}
+
+// Sender returns the host ID of the node which created the message.
+func (msg *ProtoMessage) Sender() string {
+	return msg.sender
+}
+
+// KeepAliveNonce implements KeepAliveMessage for ping and pong messages.
+func (msg *ProtoMessage) KeepAliveNonce() uint64 {
+	return msg.nonce
+}
+
+// KeepAliveTimestamp implements KeepAliveMessage for ping and pong messages.
+func (msg *ProtoMessage) KeepAliveTimestamp() time.Time {
+	if msg.pingAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, msg.pingAt)
+}
+
+func (msg *ProtoMessage) TypeURL() string {
+	if msg.any == nil {
+		return ""
+	}
+	return msg.any.GetTypeUrl()
+}
+
+func (msg *ProtoMessage) Payload() proto.Message {
+	return msg.payload
+}
+
+// ProtoMessageHelper is a MessageHelper which wraps proto.Message payloads into the Envelope
+// of envelope.proto, payload types are resolved from the global protobuf registry so every
+// generated Go type is known without registration.
+type ProtoMessageHelper struct {
+	maxMessageSize int
+
+	lock   sync.RWMutex
+	sender string
+}
+
+// NewProtoMessageHelper uses p2pio.DefaultMaxFrameSize if maxMessageSize <= 0.
+func NewProtoMessageHelper(maxMessageSize int) *ProtoMessageHelper {
+	if maxMessageSize <= 0 {
+		maxMessageSize = p2pio.DefaultMaxFrameSize
+	}
+	return &ProtoMessageHelper{
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// SetHostID implements HostAwareMessageHelper.
+func (mh *ProtoMessageHelper) SetHostID(hostID string) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.sender = hostID
+}
+
+func (mh *ProtoMessageHelper) getSender() string {
+	mh.lock.RLock()
+	defer mh.lock.RUnlock()
+
+	return mh.sender
+}
+
+func (mh *ProtoMessageHelper) NewMessage(payload proto.Message) (*ProtoMessage, error) {
+	return mh.newDataMessage(payload, false, "")
+}
+
+func (mh *ProtoMessageHelper) NewGossipMessage(payload proto.Message) (*ProtoMessage, error) {
+	return mh.newDataMessage(payload, true, "")
+}
+
+// NewResponse creates the message answering req for PeersProxy.Call.
+func (mh *ProtoMessageHelper) NewResponse(req Message, payload proto.Message) (*ProtoMessage, error) {
+	return mh.newDataMessage(payload, false, req.ID())
+}
+
+func (mh *ProtoMessageHelper) newDataMessage(payload proto.Message, gossip bool, replyTo string) (*ProtoMessage, error) {
+	a, err := anypb.New(payload)
+	if err != nil {
+		return nil, err
+	}
+	return mh.buildMessage(&ProtoMessage{
+		kind:    envelopeKindData,
+		id:      uuid.NewV4().String(),
+		gossip:  gossip,
+		sender:  mh.getSender(),
+		replyTo: replyTo,
+		payload: payload,
+		any:     a,
+	})
+}
+
+func (mh *ProtoMessageHelper) buildMessage(msg *ProtoMessage) (*ProtoMessage, error) {
+	var d []byte
+	if msg.kind != envelopeKindData {
+		d = protowire.AppendTag(d, envelopeFieldKind, protowire.VarintType)
+		d = protowire.AppendVarint(d, msg.kind)
+	}
+	for _, field := range []struct {
+		num protowire.Number
+		v   string
+	}{
+		{envelopeFieldID, msg.id},
+		{envelopeFieldSender, msg.sender},
+		{envelopeFieldReplyTo, msg.replyTo},
+		{envelopeFieldTopic, msg.topic},
+	} {
+		if field.v == "" {
+			continue
+		}
+		d = protowire.AppendTag(d, field.num, protowire.BytesType)
+		d = protowire.AppendString(d, field.v)
+	}
+	if msg.gossip {
+		d = protowire.AppendTag(d, envelopeFieldGossip, protowire.VarintType)
+		d = protowire.AppendVarint(d, protowire.EncodeBool(true))
+	}
+	if msg.hops != 0 {
+		d = protowire.AppendTag(d, envelopeFieldHops, protowire.VarintType)
+		d = protowire.AppendVarint(d, msg.hops)
+	}
+	if msg.nonce != 0 {
+		d = protowire.AppendTag(d, envelopeFieldNonce, protowire.VarintType)
+		d = protowire.AppendVarint(d, msg.nonce)
+	}
+	if msg.pingAt != 0 {
+		d = protowire.AppendTag(d, envelopeFieldPingAt, protowire.VarintType)
+		d = protowire.AppendVarint(d, uint64(msg.pingAt))
+	}
+	if msg.any != nil {
+		ad, err := proto.Marshal(msg.any)
+		if err != nil {
+			return nil, err
+		}
+		d = protowire.AppendTag(d, envelopeFieldPayload, protowire.BytesType)
+		d = protowire.AppendBytes(d, ad)
+	}
+	if msg.control != nil {
+		d = protowire.AppendTag(d, envelopeFieldControl, protowire.BytesType)
+		d = protowire.AppendBytes(d, appendControl(nil, msg.control))
+	}
+	if len(d) > mh.maxMessageSize {
+		return nil, p2pio.ErrFrameTooLarge
+	}
+
+	msg.data = p2pio.AppendFrame(nil, d)
+	return msg, nil
+}
+
+func (mh *ProtoMessageHelper) ReadMessage(reader io.Reader) (Message, error) {
+	d, err := p2pio.ReadFrame(reader, mh.maxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	return mh.parseMessage(d)
+}
+
+// nolint: funlen
+func (mh *ProtoMessageHelper) parseMessage(d []byte) (*ProtoMessage, error) {
+	msg := &ProtoMessage{
+		data: p2pio.AppendFrame(nil, d),
+	}
+
+	for len(d) > 0 {
+		num, typ, n := protowire.ConsumeTag(d)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, protowire.ParseError(n))
+		}
+		d = d[n:]
+
+		switch {
+		case num == envelopeFieldKind && typ == protowire.VarintType:
+			msg.kind, n = protowire.ConsumeVarint(d)
+		case num == envelopeFieldHops && typ == protowire.VarintType:
+			msg.hops, n = protowire.ConsumeVarint(d)
+		case num == envelopeFieldNonce && typ == protowire.VarintType:
+			msg.nonce, n = protowire.ConsumeVarint(d)
+		case num == envelopeFieldPingAt && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(d)
+			msg.pingAt = int64(v)
+		case num == envelopeFieldGossip && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(d)
+			msg.gossip = protowire.DecodeBool(v)
+		case num == envelopeFieldID && typ == protowire.BytesType:
+			msg.id, n = protowire.ConsumeString(d)
+		case num == envelopeFieldSender && typ == protowire.BytesType:
+			msg.sender, n = protowire.ConsumeString(d)
+		case num == envelopeFieldReplyTo && typ == protowire.BytesType:
+			msg.replyTo, n = protowire.ConsumeString(d)
+		case num == envelopeFieldTopic && typ == protowire.BytesType:
+			msg.topic, n = protowire.ConsumeString(d)
+		case num == envelopeFieldControl && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(d)
+			if n >= 0 {
+				var err error
+				if msg.control, err = parseControl(v); err != nil {
+					return nil, err
+				}
+			}
+		case num == envelopeFieldPayload && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(d)
+			if n >= 0 {
+				msg.any = &anypb.Any{}
+				if err := proto.Unmarshal(v, msg.any); err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, d)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, protowire.ParseError(n))
+		}
+		d = d[n:]
+	}
+
+	switch msg.kind {
+	case envelopeKindPing, envelopeKindPong:
+		return msg, nil
+	case envelopeKindControl:
+		if msg.control == nil {
+			return nil, fmt.Errorf("%w: no control", ErrInvalidMessage)
+		}
+		return msg, nil
+	case envelopeKindData:
+	default:
+		return nil, fmt.Errorf("%w: kind %v", ErrInvalidMessage, msg.kind)
+	}
+
+	if msg.any == nil {
+		return nil, fmt.Errorf("%w: no payload", ErrInvalidMessage)
+	}
+	payload, err := msg.any.UnmarshalNew()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownMessageType, err)
+	}
+	msg.payload = payload
+	return msg, nil
+}
+
+func appendControl(d []byte, ctrl *Control) []byte {
+	if ctrl.Kind != 0 {
+		d = protowire.AppendTag(d, controlFieldKind, protowire.VarintType)
+		d = protowire.AppendVarint(d, uint64(ctrl.Kind))
+	}
+	for _, topic := range ctrl.Topics {
+		d = protowire.AppendTag(d, controlFieldTopics, protowire.BytesType)
+		d = protowire.AppendString(d, topic)
+	}
+	for _, id := range ctrl.IDs {
+		d = protowire.AppendTag(d, controlFieldIDs, protowire.BytesType)
+		d = protowire.AppendString(d, id)
+	}
+	return d
+}
+
+func parseControl(d []byte) (*Control, error) {
+	ctrl := &Control{}
+	for len(d) > 0 {
+		num, typ, n := protowire.ConsumeTag(d)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, protowire.ParseError(n))
+		}
+		d = d[n:]
+
+		switch {
+		case num == controlFieldKind && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(d)
+			ctrl.Kind = ControlKind(v)
+		case num == controlFieldTopics && typ == protowire.BytesType:
+			var topic string
+			topic, n = protowire.ConsumeString(d)
+			ctrl.Topics = append(ctrl.Topics, topic)
+		case num == controlFieldIDs && typ == protowire.BytesType:
+			var id string
+			id, n = protowire.ConsumeString(d)
+			ctrl.IDs = append(ctrl.IDs, id)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, d)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, protowire.ParseError(n))
+		}
+		d = d[n:]
+	}
+	return ctrl, nil
+}
+
+func (mh *ProtoMessageHelper) CreatePingMessage(peerID string) (Message, error) {
+	return mh.buildMessage(&ProtoMessage{
+		kind:   envelopeKindPing,
+		id:     uuid.NewV4().String(),
+		sender: mh.getSender(),
+		nonce:  newKeepAliveNonce(),
+		pingAt: time.Now().UnixNano(),
+	})
+}
+
+func (mh *ProtoMessageHelper) CreatePongMessage(pingMessage Message) (Message, error) {
+	msg := &ProtoMessage{
+		kind:    envelopeKindPong,
+		id:      uuid.NewV4().String(),
+		sender:  mh.getSender(),
+		replyTo: pingMessage.ID(),
+	}
+	if ping, ok := pingMessage.(*ProtoMessage); ok {
+		msg.nonce = ping.nonce
+		msg.pingAt = ping.pingAt
+	}
+	return mh.buildMessage(msg)
+}
+
+func (mh *ProtoMessageHelper) IsPingMessage(message Message) bool {
+	msg, ok := message.(*ProtoMessage)
+	return ok && msg.kind == envelopeKindPing
+}
+
+func (mh *ProtoMessageHelper) IsPongMessage(message Message) bool {
+	msg, ok := message.(*ProtoMessage)
+	return ok && msg.kind == envelopeKindPong
+}
+
+func (mh *ProtoMessageHelper) GetMessageMeta(message Message) MessageMeta {
+	msg, ok := message.(*ProtoMessage)
+	if !ok {
+		return MessageMeta{}
+	}
+	return MessageMeta{
+		Topic: msg.topic,
+		Hops:  wireHops(msg.hops),
+	}
+}
+
+func (mh *ProtoMessageHelper) SetMessageMeta(message Message, meta MessageMeta) (Message, error) {
+	msg, ok := message.(*ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnknownMessageType, message)
+	}
+	newMsg := *msg
+	newMsg.topic = meta.Topic
+	newMsg.hops = uint64(meta.Hops)
+	return mh.buildMessage(&newMsg)
+}
+
+func (mh *ProtoMessageHelper) CreateControlMessage(ctrl *Control) (Message, error) {
+	return mh.buildMessage(&ProtoMessage{
+		kind:    envelopeKindControl,
+		id:      uuid.NewV4().String(),
+		sender:  mh.getSender(),
+		control: ctrl,
+	})
+}
+
+func (mh *ProtoMessageHelper) ParseControlMessage(message Message) *Control {
+	msg, ok := message.(*ProtoMessage)
+	if !ok || msg.kind != envelopeKindControl {
+		return nil
+	}
+	return msg.control
+}
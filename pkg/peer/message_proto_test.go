@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtoMessageHelper(t *testing.T) {
+	mh := NewProtoMessageHelper(0)
+	mh.SetHostID("host-a")
+
+	req, err := mh.NewGossipMessage(wrapperspb.String("hello"))
+	assert.Nil(t, err)
+	resp, err := mh.NewResponse(req, wrapperspb.Int64(42))
+	assert.Nil(t, err)
+	ping, err := mh.CreatePingMessage("host-b")
+	assert.Nil(t, err)
+	pong, err := mh.CreatePongMessage(ping)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	for _, msg := range []Message{req, resp, ping, pong} {
+		buf.Write(msg.Bytes())
+	}
+
+	msg, err := mh.ReadMessage(&buf)
+	assert.Nil(t, err)
+	pMsg := msg.(*ProtoMessage)
+	assert.Equal(t, req.ID(), pMsg.ID())
+	assert.True(t, pMsg.GossipFlag())
+	assert.Equal(t, "host-a", pMsg.Sender())
+	assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", pMsg.TypeURL())
+	assert.True(t, proto.Equal(wrapperspb.String("hello"), pMsg.Payload()))
+
+	msg, err = mh.ReadMessage(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, req.ID(), msg.(ResponseMessage).ReplyTo())
+	assert.True(t, proto.Equal(wrapperspb.Int64(42), msg.(*ProtoMessage).Payload()))
+
+	msg, err = mh.ReadMessage(&buf)
+	assert.Nil(t, err)
+	assert.True(t, mh.IsPingMessage(msg))
+
+	msg, err = mh.ReadMessage(&buf)
+	assert.Nil(t, err)
+	assert.True(t, mh.IsPongMessage(msg))
+	assert.NotZero(t, msg.(KeepAliveMessage).KeepAliveNonce())
+	assert.Equal(t, ping.(KeepAliveMessage).KeepAliveNonce(), msg.(KeepAliveMessage).KeepAliveNonce())
+	assert.True(t, ping.(KeepAliveMessage).KeepAliveTimestamp().Equal(msg.(KeepAliveMessage).KeepAliveTimestamp()))
+}
+
+func TestProtoMessageHelperInvalid(t *testing.T) {
+	mh := NewProtoMessageHelper(0)
+	_, err := mh.ReadMessage(bytes.NewReader([]byte{3, 0xff, 0xff, 0xff}))
+	assert.ErrorIs(t, err, ErrInvalidMessage)
+}
+
+// envelopeFields strips the encoding of msg and keeps what is sent.
+func envelopeFields(msg Message) ProtoMessage {
+	fields := *msg.(*ProtoMessage)
+	fields.data, fields.any, fields.payload, fields.priority = nil, nil, nil, PriorityNormal
+	return fields
+}
+
+func TestProtoMessageRoundTrip(t *testing.T) {
+	mh := NewProtoMessageHelper(0)
+	mh.SetHostID("host-a")
+
+	req, err := mh.NewGossipMessage(wrapperspb.String("hello"))
+	assert.Nil(t, err)
+	topicReq, err := mh.SetMessageMeta(req, MessageMeta{Topic: "news", Hops: 3})
+	assert.Nil(t, err)
+	resp, err := mh.NewResponse(req, wrapperspb.Int64(42))
+	assert.Nil(t, err)
+	ping, err := mh.CreatePingMessage("host-b")
+	assert.Nil(t, err)
+	pong, err := mh.CreatePongMessage(ping)
+	assert.Nil(t, err)
+	ctrl, err := mh.CreateControlMessage(&Control{
+		Kind:   ControlIHave,
+		Topics: []string{"news", "sport"},
+		IDs:    []string{"1", "2", "3"},
+	})
+	assert.Nil(t, err)
+
+	for _, msg := range []Message{req, topicReq, resp, ping, pong, ctrl} {
+		parsed, err := mh.ReadMessage(bytes.NewReader(msg.Bytes()))
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, envelopeFields(msg), envelopeFields(parsed))
+		assert.Equal(t, msg.Bytes(), parsed.Bytes())
+		assert.True(t, proto.Equal(msg.(*ProtoMessage).Payload(), parsed.(*ProtoMessage).Payload()))
+	}
+
+	// every field of the envelope is set by one of the messages
+	fields := envelopeFields(topicReq)
+	assert.Equal(t, ProtoMessage{kind: envelopeKindData, id: req.ID(), gossip: true, sender: "host-a",
+		topic: "news", hops: 3}, fields)
+	assert.Equal(t, req.ID(), envelopeFields(resp).replyTo)
+	assert.NotZero(t, envelopeFields(pong).nonce)
+	assert.NotZero(t, envelopeFields(pong).pingAt)
+	assert.Equal(t, uint64(envelopeKindPong), envelopeFields(pong).kind)
+	assert.Equal(t, &Control{
+		Kind:   ControlIHave,
+		Topics: []string{"news", "sport"},
+		IDs:    []string{"1", "2", "3"},
+	}, mh.ParseControlMessage(ctrl))
+}
@@ -0,0 +1,397 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+)
+
+const (
+	registryKindData byte = iota
+	registryKindPing
+	registryKindPong
+	registryKindControl
+)
+
+const registryFlagGossip byte = 0x01
+
+var (
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrInvalidMessage     = errors.New("invalid message")
+)
+
+// RegistryMessage is the Message created and read by RegistryMessageHelper.
+type RegistryMessage struct {
+	kind     byte
+	typeName string
+	id       string
+	replyTo  string
+	topic    string
+	hops     int
+	gossip   bool
+	nonce    uint64
+	pingTime time.Time
+	payload  interface{}
+	control  *Control
+	// payloadData is the encoded payload, kept to re-encode the message with a new MessageMeta
+	payloadData []byte
+	data        []byte
+	// priority is local to this node, it is not sent
+	priority Priority
+}
+
+func (msg *RegistryMessage) Bytes() []byte {
+	return msg.data
+}
+
+// Priority implements PriorityMessage.
+func (msg *RegistryMessage) Priority() Priority {
+	return msg.priority
+}
+
+// SetPriority sets the priority the message is queued with, it returns msg.
+func (msg *RegistryMessage) SetPriority(priority Priority) *RegistryMessage {
+	msg.priority = priority
+	return msg
+}
+
+func (msg *RegistryMessage) ID() string {
+	return msg.id
+}
+
+func (msg *RegistryMessage) GossipFlag() bool {
+	return msg.gossip
+}
+
+func (msg *RegistryMessage) ReplyTo() string {
+	return msg.replyTo
+}
+
+func (msg *RegistryMessage) TypeName() string {
+	return msg.typeName
+}
+
+// KeepAliveNonce implements KeepAliveMessage for ping and pong messages.
+func (msg *RegistryMessage) KeepAliveNonce() uint64 {
+	return msg.nonce
+}
+
+// KeepAliveTimestamp implements KeepAliveMessage for ping and pong messages.
+func (msg *RegistryMessage) KeepAliveTimestamp() time.Time {
+	return msg.pingTime
+}
+
+// Payload returns the decoded payload, a pointer to the registered type.
+func (msg *RegistryMessage) Payload() interface{} {
+	return msg.payload
+}
+
+// RegistryMessageHelper is a MessageHelper for applications which only register their payload types.
+// Each message is a length prefixed frame holding the message header and the payload encoded by a
+// PayloadCodec, ping and pong are built in.
+type RegistryMessageHelper struct {
+	codec          PayloadCodec
+	maxMessageSize int
+
+	lock  sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// NewRegistryMessageHelper uses JSONCodec if codec is nil and p2pio.DefaultMaxFrameSize
+// if maxMessageSize <= 0.
+func NewRegistryMessageHelper(codec PayloadCodec, maxMessageSize int) *RegistryMessageHelper {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	if maxMessageSize <= 0 {
+		maxMessageSize = p2pio.DefaultMaxFrameSize
+	}
+	return &RegistryMessageHelper{
+		codec:          codec,
+		maxMessageSize: maxMessageSize,
+		types:          make(map[string]reflect.Type),
+		names:          make(map[reflect.Type]string),
+	}
+}
+
+func payloadType(payload interface{}) reflect.Type {
+	t := reflect.TypeOf(payload)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Register binds typeName to the type of payload, payload may be a value or a pointer.
+func (mh *RegistryMessageHelper) Register(typeName string, payload interface{}) error {
+	t := payloadType(payload)
+	if typeName == "" || t == nil {
+		return errors.New("invalid type registration")
+	}
+
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	if _, ok := mh.types[typeName]; ok {
+		return fmt.Errorf("type %v already registered", typeName)
+	}
+	if _, ok := mh.names[t]; ok {
+		return fmt.Errorf("type %v already registered", t)
+	}
+	mh.types[typeName] = t
+	mh.names[t] = typeName
+	return nil
+}
+
+func (mh *RegistryMessageHelper) NewMessage(payload interface{}) (*RegistryMessage, error) {
+	return mh.newDataMessage(payload, false, "")
+}
+
+func (mh *RegistryMessageHelper) NewGossipMessage(payload interface{}) (*RegistryMessage, error) {
+	return mh.newDataMessage(payload, true, "")
+}
+
+// NewResponse creates the message answering req for PeersProxy.Call.
+func (mh *RegistryMessageHelper) NewResponse(req Message, payload interface{}) (*RegistryMessage, error) {
+	return mh.newDataMessage(payload, false, req.ID())
+}
+
+func (mh *RegistryMessageHelper) newDataMessage(payload interface{}, gossip bool, replyTo string) (*RegistryMessage, error) {
+	mh.lock.RLock()
+	typeName, ok := mh.names[payloadType(payload)]
+	mh.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnknownMessageType, payload)
+	}
+
+	d, err := mh.codec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return mh.buildMessage(&RegistryMessage{
+		kind:     registryKindData,
+		typeName: typeName,
+		id:       uuid.NewV4().String(),
+		replyTo:  replyTo,
+		gossip:   gossip,
+		payload:  payload,
+	}, d)
+}
+
+func appendString(d []byte, s string) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(s)))
+	d = append(d, lenBuf[:n]...)
+	return append(d, s...)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if size > uint64(r.Len()) {
+		return "", ErrInvalidMessage
+	}
+	d := make([]byte, size)
+	_, _ = r.Read(d)
+	return string(d), nil
+}
+
+func (mh *RegistryMessageHelper) buildMessage(msg *RegistryMessage, payloadData []byte) (*RegistryMessage, error) {
+	d := []byte{msg.kind}
+	d = appendString(d, msg.typeName)
+	d = appendString(d, msg.id)
+	d = appendString(d, msg.replyTo)
+	d = appendString(d, msg.topic)
+	var hopsBuf [binary.MaxVarintLen64]byte
+	d = append(d, hopsBuf[:binary.PutUvarint(hopsBuf[:], uint64(msg.hops))]...)
+	var flags byte
+	if msg.gossip {
+		flags |= registryFlagGossip
+	}
+	d = append(d, flags)
+	d = append(d, payloadData...)
+	if len(d) > mh.maxMessageSize {
+		return nil, p2pio.ErrFrameTooLarge
+	}
+
+	msg.payloadData = payloadData
+	msg.data = p2pio.AppendFrame(nil, d)
+	return msg, nil
+}
+
+func (mh *RegistryMessageHelper) ReadMessage(reader io.Reader) (Message, error) {
+	d, err := p2pio.ReadFrame(reader, mh.maxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	return mh.parseMessage(d)
+}
+
+func (mh *RegistryMessageHelper) parseMessage(d []byte) (*RegistryMessage, error) {
+	r := bytes.NewReader(d)
+	msg := &RegistryMessage{}
+
+	var err error
+	if msg.kind, err = r.ReadByte(); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if msg.typeName, err = readString(r); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if msg.id, err = readString(r); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if msg.replyTo, err = readString(r); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if msg.topic, err = readString(r); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	hops, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	msg.hops = wireHops(hops)
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	msg.gossip = flags&registryFlagGossip != 0
+	msg.payloadData = d[len(d)-r.Len():]
+	msg.data = p2pio.AppendFrame(nil, d)
+
+	switch msg.kind {
+	case registryKindPing, registryKindPong:
+		// older peers send no keepalive payload
+		if len(msg.payloadData) > 0 {
+			kr := bytes.NewReader(msg.payloadData)
+			if msg.nonce, err = binary.ReadUvarint(kr); err != nil {
+				return nil, ErrInvalidMessage
+			}
+			ts, err := binary.ReadVarint(kr)
+			if err != nil {
+				return nil, ErrInvalidMessage
+			}
+			msg.pingTime = time.Unix(0, ts)
+		}
+		return msg, nil
+	case registryKindControl:
+		msg.control = &Control{}
+		if err = json.Unmarshal(msg.payloadData, msg.control); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		return msg, nil
+	case registryKindData:
+	default:
+		return nil, fmt.Errorf("%w: kind %v", ErrInvalidMessage, msg.kind)
+	}
+
+	mh.lock.RLock()
+	t, ok := mh.types[msg.typeName]
+	mh.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownMessageType, msg.typeName)
+	}
+
+	payload := reflect.New(t).Interface()
+	if err = mh.codec.Unmarshal(msg.payloadData, payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	msg.payload = payload
+	return msg, nil
+}
+
+func appendKeepAlive(d []byte, nonce uint64, pingTime time.Time) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	d = append(d, buf[:binary.PutUvarint(buf[:], nonce)]...)
+	return append(d, buf[:binary.PutVarint(buf[:], pingTime.UnixNano())]...)
+}
+
+func (mh *RegistryMessageHelper) CreatePingMessage(peerID string) (Message, error) {
+	msg := &RegistryMessage{
+		kind:     registryKindPing,
+		id:       uuid.NewV4().String(),
+		nonce:    newKeepAliveNonce(),
+		pingTime: time.Now(),
+	}
+	return mh.buildMessage(msg, appendKeepAlive(nil, msg.nonce, msg.pingTime))
+}
+
+func (mh *RegistryMessageHelper) CreatePongMessage(pingMessage Message) (Message, error) {
+	msg := &RegistryMessage{
+		kind:    registryKindPong,
+		id:      uuid.NewV4().String(),
+		replyTo: pingMessage.ID(),
+	}
+	ping, ok := pingMessage.(*RegistryMessage)
+	if !ok || ping.pingTime.IsZero() {
+		return mh.buildMessage(msg, nil)
+	}
+	msg.nonce = ping.nonce
+	msg.pingTime = ping.pingTime
+	return mh.buildMessage(msg, appendKeepAlive(nil, msg.nonce, msg.pingTime))
+}
+
+func (mh *RegistryMessageHelper) IsPingMessage(message Message) bool {
+	msg, ok := message.(*RegistryMessage)
+	return ok && msg.kind == registryKindPing
+}
+
+func (mh *RegistryMessageHelper) IsPongMessage(message Message) bool {
+	msg, ok := message.(*RegistryMessage)
+	return ok && msg.kind == registryKindPong
+}
+
+func (mh *RegistryMessageHelper) GetMessageMeta(message Message) MessageMeta {
+	msg, ok := message.(*RegistryMessage)
+	if !ok {
+		return MessageMeta{}
+	}
+	return MessageMeta{
+		Topic: msg.topic,
+		Hops:  msg.hops,
+	}
+}
+
+func (mh *RegistryMessageHelper) SetMessageMeta(message Message, meta MessageMeta) (Message, error) {
+	msg, ok := message.(*RegistryMessage)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnknownMessageType, message)
+	}
+	newMsg := *msg
+	newMsg.topic = meta.Topic
+	newMsg.hops = meta.Hops
+	return mh.buildMessage(&newMsg, msg.payloadData)
+}
+
+func (mh *RegistryMessageHelper) CreateControlMessage(ctrl *Control) (Message, error) {
+	d, err := json.Marshal(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	return mh.buildMessage(&RegistryMessage{
+		kind:    registryKindControl,
+		id:      uuid.NewV4().String(),
+		control: ctrl,
+	}, d)
+}
+
+func (mh *RegistryMessageHelper) ParseControlMessage(message Message) *Control {
+	msg, ok := message.(*RegistryMessage)
+	if !ok || msg.kind != registryKindControl {
+		return nil
+	}
+	return msg.control
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type registryTestPayload struct {
+	Text string
+	N    int
+}
+
+func TestRegistryMessageHelper(t *testing.T) {
+	for _, codec := range []PayloadCodec{JSONCodec{}, GobCodec{}} {
+		mh := NewRegistryMessageHelper(codec, 0)
+		assert.Nil(t, mh.Register("test", &registryTestPayload{}))
+		assert.NotNil(t, mh.Register("test", &registryTestPayload{}))
+
+		req, err := mh.NewGossipMessage(&registryTestPayload{Text: "hello", N: 3})
+		assert.Nil(t, err)
+		resp, err := mh.NewResponse(req, registryTestPayload{Text: "world"})
+		assert.Nil(t, err)
+		ping, err := mh.CreatePingMessage("peer")
+		assert.Nil(t, err)
+
+		var buf bytes.Buffer
+		for _, msg := range []Message{req, resp, ping} {
+			buf.Write(msg.Bytes())
+		}
+
+		msg, err := mh.ReadMessage(&buf)
+		assert.Nil(t, err)
+		assert.Equal(t, req.ID(), msg.ID())
+		assert.True(t, msg.GossipFlag())
+		assert.Equal(t, &registryTestPayload{Text: "hello", N: 3}, msg.(*RegistryMessage).Payload())
+
+		msg, err = mh.ReadMessage(&buf)
+		assert.Nil(t, err)
+		assert.Equal(t, req.ID(), msg.(ResponseMessage).ReplyTo())
+		assert.False(t, msg.GossipFlag())
+
+		msg, err = mh.ReadMessage(&buf)
+		assert.Nil(t, err)
+		assert.True(t, mh.IsPingMessage(msg))
+		assert.False(t, mh.IsPongMessage(msg))
+
+		pong, err := mh.CreatePongMessage(msg)
+		assert.Nil(t, err)
+		msg, err = mh.ReadMessage(bytes.NewReader(pong.Bytes()))
+		assert.Nil(t, err)
+		assert.True(t, mh.IsPongMessage(msg))
+		assert.NotZero(t, msg.(KeepAliveMessage).KeepAliveNonce())
+		assert.Equal(t, ping.(KeepAliveMessage).KeepAliveNonce(), msg.(KeepAliveMessage).KeepAliveNonce())
+		assert.True(t, ping.(KeepAliveMessage).KeepAliveTimestamp().Equal(msg.(KeepAliveMessage).KeepAliveTimestamp()))
+	}
+}
+
+func TestRegistryMessageHelperUnknownType(t *testing.T) {
+	mh := NewRegistryMessageHelper(nil, 0)
+	_, err := mh.NewMessage(&registryTestPayload{})
+	assert.ErrorIs(t, err, ErrUnknownMessageType)
+
+	other := NewRegistryMessageHelper(nil, 0)
+	assert.Nil(t, other.Register("test", registryTestPayload{}))
+	msg, err := other.NewMessage(&registryTestPayload{})
+	assert.Nil(t, err)
+	_, err = mh.ReadMessage(bytes.NewReader(msg.Bytes()))
+	assert.ErrorIs(t, err, ErrUnknownMessageType)
+}
+
+func TestRegistryMessageHelperHops(t *testing.T) {
+	mh := NewRegistryMessageHelper(nil, 0)
+	assert.Nil(t, mh.Register("test", registryTestPayload{}))
+	msg, err := mh.NewGossipMessage(&registryTestPayload{})
+	assert.Nil(t, err)
+
+	// the hops of a peer are read as uint64
+	regMsg := *msg
+	regMsg.hops = -1
+	wrapped, err := mh.buildMessage(&regMsg, regMsg.payloadData)
+	assert.Nil(t, err)
+	read, err := mh.ReadMessage(bytes.NewReader(wrapped.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, maxWireHops, mh.GetMessageMeta(read).Hops)
+}
@@ -0,0 +1,107 @@
+package peer
+
+import (
+	"sort"
+	"sync"
+)
+
+// peerNamespaces keeps the namespaces the peers are discovered in, it is written by the pmr
+// routine and read by the others. The empty namespace stands for the discoverers without
+// namespaces, it is not reported.
+type peerNamespaces struct {
+	lock  sync.RWMutex
+	peers map[string]map[string]bool
+}
+
+func newPeerNamespaces() *peerNamespaces {
+	return &peerNamespaces{
+		peers: make(map[string]map[string]bool),
+	}
+}
+
+// add returns whether ns is the first namespace of the peer.
+func (pn *peerNamespaces) add(peerID, ns string) bool {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+
+	namespaces, ok := pn.peers[peerID]
+	if !ok {
+		namespaces = make(map[string]bool)
+		pn.peers[peerID] = namespaces
+	}
+	namespaces[ns] = true
+	return !ok
+}
+
+// remove returns whether ns was the last namespace of the peer.
+func (pn *peerNamespaces) remove(peerID, ns string) bool {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+
+	namespaces, ok := pn.peers[peerID]
+	if !ok || !namespaces[ns] {
+		return false
+	}
+	delete(namespaces, ns)
+	if len(namespaces) > 0 {
+		return false
+	}
+	delete(pn.peers, peerID)
+	return true
+}
+
+func (pn *peerNamespaces) get(peerID string) []string {
+	pn.lock.RLock()
+	defer pn.lock.RUnlock()
+
+	var namespaces []string
+	for ns := range pn.peers[peerID] {
+		if ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// PeerFilter selects the peers ListPeers and ListPeerInfos report.
+type PeerFilter func(info *PeerInfo) bool
+
+// InNamespace selects the peers discovered in ns.
+func InNamespace(ns string) PeerFilter {
+	return func(info *PeerInfo) bool {
+		for _, n := range info.Namespaces {
+			if n == ns {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithState selects the peers in state.
+func WithState(state PeerState) PeerFilter {
+	return func(info *PeerInfo) bool {
+		return info.State == state
+	}
+}
+
+func filterPeerInfos(infos []PeerInfo, filters []PeerFilter) []PeerInfo {
+	if len(filters) == 0 {
+		return infos
+	}
+	filtered := infos[:0]
+	for idx := range infos {
+		selected := true
+		for _, filter := range filters {
+			if !filter(&infos[idx]) {
+				selected = false
+				break
+			}
+		}
+		if selected {
+			filtered = append(filtered, infos[idx])
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,43 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerNamespaces(t *testing.T) {
+	pn := newPeerNamespaces()
+
+	assert.True(t, pn.add("a", "eu"))
+	assert.False(t, pn.add("a", "us"))
+	assert.False(t, pn.add("a", ""))
+	assert.Equal(t, []string{"eu", "us"}, pn.get("a"))
+
+	assert.False(t, pn.remove("a", "asia"))
+	assert.False(t, pn.remove("a", "eu"))
+	assert.False(t, pn.remove("a", "us"))
+	assert.Empty(t, pn.get("a"))
+	assert.True(t, pn.remove("a", ""))
+	assert.False(t, pn.remove("a", ""))
+}
+
+func TestFilterPeerInfos(t *testing.T) {
+	infos := []PeerInfo{
+		{PeerID: "a", State: PeerStateConnected, Namespaces: []string{"eu"}},
+		{PeerID: "b", State: PeerStateIdle, Namespaces: []string{"eu", "us"}},
+		{PeerID: "c", State: PeerStateConnected, Namespaces: []string{"us"}},
+	}
+	ids := func(infos []PeerInfo) []string {
+		var ids []string
+		for _, info := range infos {
+			ids = append(ids, info.PeerID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"a", "b", "c"}, ids(filterPeerInfos(append([]PeerInfo(nil), infos...), nil)))
+	assert.Equal(t, []string{"b", "c"}, ids(filterPeerInfos(append([]PeerInfo(nil), infos...), []PeerFilter{InNamespace("us")})))
+	assert.Equal(t, []string{"a"}, ids(filterPeerInfos(append([]PeerInfo(nil), infos...),
+		[]PeerFilter{InNamespace("eu"), WithState(PeerStateConnected)})))
+}
@@ -0,0 +1,90 @@
+package peer
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+type PeerState int
+
+const (
+	PeerStateIdle PeerState = iota
+	PeerStateConnected
+)
+
+func (state PeerState) String() string {
+	if state == PeerStateConnected {
+		return "connected"
+	}
+	return "idle"
+}
+
+type PeerDirection int
+
+const (
+	DirectionUnknown PeerDirection = iota
+	// DirectionInbound is a stream the remote peer opened
+	DirectionInbound
+	// DirectionOutbound is a stream this node opened
+	DirectionOutbound
+)
+
+func (direction PeerDirection) String() string {
+	switch direction {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+type PeerInfo struct {
+	PeerID         string
+	State          PeerState
+	Direction      PeerDirection
+	RemoteAddrs    []string
+	ConnectedSince time.Time
+	// LastPong is zero until the peer answers a ping
+	LastPong time.Time
+	RTTStats
+
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	SendQueueLength  int
+	// Score is the score of the peer, see ScorePolicy
+	Score float64
+	// Namespaces are the advertise namespaces the peer is discovered in
+	Namespaces []string
+}
+
+// countingReader counts the bytes ReadMessage takes from the stream.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.n, uint64(n))
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	if br, ok := cr.r.(io.ByteReader); ok {
+		b, err := br.ReadByte()
+		if err == nil {
+			atomic.AddUint64(cr.n, 1)
+		}
+		return b, err
+	}
+	var p [1]byte
+	if _, err := io.ReadFull(cr, p[:]); err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
@@ -2,79 +2,187 @@ package peer
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
 	"github.com/sgostarter/libp2p/pkg/p2pio"
 )
 
+const defaultWriteTimeout = 30 * time.Second
+
 type closeObserver interface {
-	PeerClosed(PeerProxy)
+	PeerClosed(peer PeerProxy, reason error)
 }
 
 type messageArrivedObserver interface {
 	OnDataArrived(PeerProxy, Message)
 }
 
+type misbehaviorObserver interface {
+	PeerMisbehaved(peer PeerProxy, misbehavior Misbehavior)
+}
+
 // nolint: golint
 type PeerProxy interface {
 	GetPeerID() string
 	DoRequest(req Message)
+	// Send is DoRequest with a delivery report, fnResult may be nil. A full send queue is
+	// handled by the overflow policy.
+	Send(req Message, fnResult func(err error))
+	// TrySend never blocks, it returns ErrSendQueueFull if req can't be queued. fnResult
+	// may be nil, it gets the error too.
+	TrySend(req Message, fnResult func(err error)) error
 	Disconnect()
+	// DisconnectWithReason closes the peer, reason is reported to the close observer.
+	DisconnectWithReason(reason error)
+	GetInfo() PeerInfo
+	GetRTTStats() RTTStats
+}
+
+type peerRequest struct {
+	msg      Message
+	priority Priority
+	fnResult func(err error)
+}
+
+func (req *peerRequest) done(err error) {
+	if req.fnResult != nil {
+		req.fnResult(err)
+	}
 }
 
 type peerProxyImpl struct {
+	// counters, accessed atomically
+	bytesSent        uint64
+	bytesReceived    uint64
+	messagesSent     uint64
+	messagesReceived uint64
+
 	ctx              context.Context
 	peerID           string
+	direction        PeerDirection
+	connectedSince   time.Time
 	rwc              *p2pio.ReadWriteCloser
 	closeOb          closeObserver
 	messageArrivedOb messageArrivedObserver
+	misbehaviorOb    misbehaviorObserver
 	messageHelper    MessageHelper
-	lastTouch        time.Time
-	ch2Write         chan Message
-	keepAlive        time.Duration
+	sendQueue        *sendQueue
+	keepAlive        KeepAlivePolicy
+	writeTimeout     time.Duration
+	limiter          *inboundLimiter
+	wg               *sync.WaitGroup
+	chClosed         chan interface{}
+	chKick           chan error
+
+	infoLock sync.Mutex
+	// lastPong is zero until the first pong
+	lastPong time.Time
+	rtt      rttEstimator
 }
 
-func newPeerProxy(ctx context.Context, peerID string, rwc *p2pio.ReadWriteCloser, closeOb closeObserver,
-	messageArrivedOb messageArrivedObserver, messageHelper MessageHelper, keepAlive time.Duration) PeerProxy {
+func newPeerProxy(ctx context.Context, wg *sync.WaitGroup, peerID string, direction PeerDirection, rwc *p2pio.ReadWriteCloser,
+	closeOb closeObserver, messageArrivedOb messageArrivedObserver, misbehaviorOb misbehaviorObserver, messageHelper MessageHelper,
+	keepAlive KeepAlivePolicy, sendQueue SendQueuePolicy, writeTimeout time.Duration, limiter *inboundLimiter) PeerProxy {
+	if writeTimeout <= 0 {
+		writeTimeout = defaultWriteTimeout
+	}
 	impl := &peerProxyImpl{
 		ctx:              ctx,
 		peerID:           peerID,
+		direction:        direction,
+		connectedSince:   time.Now(),
 		rwc:              rwc,
 		closeOb:          closeOb,
 		messageArrivedOb: messageArrivedOb,
+		misbehaviorOb:    misbehaviorOb,
 		messageHelper:    messageHelper,
-		lastTouch:        time.Now(),
-		ch2Write:         make(chan Message, 2),
+		sendQueue:        newSendQueue(sendQueue),
 		keepAlive:        keepAlive,
+		writeTimeout:     writeTimeout,
+		limiter:          limiter,
+		wg:               wg,
+		chClosed:         make(chan interface{}),
+		chKick:           make(chan error, 1),
 	}
+	impl.wg.Add(2)
 	go impl.rwRoutine()
 
 	return impl
 }
 
 func (impl *peerProxyImpl) rwRoutine() {
+	defer impl.wg.Done()
+
 	chMsgIncoming := make(chan Message, 2)
 	chReadError := make(chan error, 1)
 
 	go func() {
+		defer impl.wg.Done()
 		defer func() {
 			_ = impl.rwc.Close()
 		}()
+		reader := &countingReader{
+			r: impl.rwc,
+			n: &impl.bytesReceived,
+		}
 		for {
-			msg, err := impl.messageHelper.ReadMessage(impl.rwc)
+			msg, err := impl.messageHelper.ReadMessage(reader)
+			if errors.Is(err, ErrInvalidMessage) || errors.Is(err, ErrUnknownMessageType) {
+				// the frame was read, the stream is still usable
+				loge.Warnf(impl.ctx, "peer %v sent a bad message: %v", impl.peerID, err)
+				impl.misbehaviorOb.PeerMisbehaved(impl, MisbehaviorDecodeFailure)
+				continue
+			}
+			if errors.Is(err, p2pio.ErrFrameTooLarge) {
+				impl.misbehaviorOb.PeerMisbehaved(impl, MisbehaviorDecodeFailure)
+			}
 			if err != nil {
 				chReadError <- err
 				loge.Errorf(impl.ctx, "peer %v read failed: %v", impl.peerID, err)
 				break
 			}
 			loge.Debugf(nil, "-- receive: %v", msg)
-			chMsgIncoming <- msg
+			atomic.AddUint64(&impl.messagesReceived, 1)
+			if !impl.messageHelper.IsPingMessage(msg) && !impl.messageHelper.IsPongMessage(msg) {
+				deliver, err := impl.rateLimit(msg)
+				if err != nil {
+					chReadError <- err
+					loge.Warnf(impl.ctx, "peer %v closed: %v", impl.peerID, err)
+					break
+				}
+				if !deliver {
+					continue
+				}
+			}
+			select {
+			case chMsgIncoming <- msg:
+			case <-impl.chClosed:
+				return
+			}
 		}
 	}()
 
-	timeoutChecker := time.NewTicker(impl.keepAlive)
-	pingTicker := time.NewTicker(impl.keepAlive / 3)
+	pingTicker := time.NewTicker(impl.keepAlive.PingInterval)
+	pongTimer := time.NewTimer(impl.keepAlive.PongTimeout)
+	pongTimer.Stop()
+
+	// fnCheckMissedPongs returns the reason the peer is dead, nil while it is alive
+	fnCheckMissedPongs := func() error {
+		impl.infoLock.Lock()
+		missed := impl.rtt.stats.MissedPongs
+		impl.infoLock.Unlock()
+		if missed > impl.keepAlive.MaxMissedPongs {
+			return fmt.Errorf("%w: %v pongs missed", ErrKeepAliveTimeout, missed)
+		}
+		return nil
+	}
 
 	fnSendPing := func() {
 		pingMsg, err := impl.messageHelper.CreatePingMessage(impl.peerID)
@@ -82,7 +190,24 @@ func (impl *peerProxyImpl) rwRoutine() {
 			loge.Errorf(impl.ctx, "peer %v create ping message failed: %v", impl.peerID, err)
 			return
 		}
-		impl.ch2Write <- pingMsg
+		var nonce uint64
+		if kaMsg, ok := pingMsg.(KeepAliveMessage); ok {
+			nonce = kaMsg.KeepAliveNonce()
+		}
+		impl.infoLock.Lock()
+		missed := impl.rtt.onPing(nonce, time.Now())
+		impl.infoLock.Unlock()
+		if missed {
+			impl.misbehaviorOb.PeerMisbehaved(impl, MisbehaviorMissedPong)
+		}
+		if !pongTimer.Stop() {
+			select {
+			case <-pongTimer.C:
+			default:
+			}
+		}
+		pongTimer.Reset(impl.keepAlive.PongTimeout)
+		_ = impl.sendQueue.push(&peerRequest{msg: pingMsg, priority: PriorityControl}, false)
 	}
 
 	fnSendPong := func(pingMsg Message) {
@@ -91,44 +216,139 @@ func (impl *peerProxyImpl) rwRoutine() {
 			loge.Errorf(impl.ctx, "peer %v create pong message failed: %v", impl.peerID, err)
 			return
 		}
-		impl.ch2Write <- pongMsg
+		_ = impl.sendQueue.push(&peerRequest{msg: pongMsg, priority: PriorityControl}, false)
 	}
 
-	loop := true
-	for loop {
+	var reason error
+	for reason == nil {
 		select {
-		case <-chReadError:
-			loop = false
-		case <-timeoutChecker.C:
-			loge.Errorf(impl.ctx, "peer %v timeout exit rw routine", impl.peerID)
-			loop = false
+		case <-impl.ctx.Done():
+			reason = ErrClosed
+		case err := <-chReadError:
+			reason = err
+			if errors.Is(err, io.EOF) {
+				reason = ErrPeerClosed
+			}
+		case reason = <-impl.chKick:
+		case <-pongTimer.C:
+			impl.infoLock.Lock()
+			missed := impl.rtt.onPongTimeout()
+			impl.infoLock.Unlock()
+			if missed {
+				impl.misbehaviorOb.PeerMisbehaved(impl, MisbehaviorMissedPong)
+			}
+			reason = fnCheckMissedPongs()
 		case <-pingTicker.C:
 			fnSendPing()
-		case msg := <-impl.ch2Write:
-			_, err := impl.rwc.Write(msg.Bytes())
-			if err != nil {
-				loge.Errorf(impl.ctx, "write message failed: %v", err)
+			reason = fnCheckMissedPongs()
+		case <-impl.sendQueue.notify:
+			if impl.sendQueue.isOverflowed() {
+				reason = ErrSendQueueFull
 				break
 			}
-			_ = impl.rwc.Flush()
-			loge.Debugf(nil, "-- send: %v", msg)
+			req := impl.sendQueue.pop()
+			if req == nil {
+				break
+			}
+			d := req.msg.Bytes()
+			if err := impl.write(d); err != nil {
+				loge.Errorf(impl.ctx, "peer %v write message failed: %v", impl.peerID, err)
+				req.done(err)
+				reason = err
+				break
+			}
+			atomic.AddUint64(&impl.bytesSent, uint64(len(d)))
+			atomic.AddUint64(&impl.messagesSent, 1)
+			req.done(nil)
+			loge.Debugf(nil, "-- send: %v", req.msg)
 		case msg := <-chMsgIncoming:
 			if impl.messageHelper.IsPingMessage(msg) {
 				fnSendPong(msg)
 			} else if impl.messageHelper.IsPongMessage(msg) {
-				impl.lastTouch = time.Now()
-				timeoutChecker.Reset(10 * time.Minute)
+				var nonce uint64
+				if kaMsg, ok := msg.(KeepAliveMessage); ok {
+					nonce = kaMsg.KeepAliveNonce()
+				}
+				impl.infoLock.Lock()
+				impl.lastPong = time.Now()
+				answered := impl.rtt.onPong(nonce, impl.lastPong)
+				impl.infoLock.Unlock()
+				if answered {
+					pongTimer.Stop()
+				}
 			} else {
 				impl.messageArrivedOb.OnDataArrived(impl, msg)
 			}
 		}
 	}
+	close(impl.chClosed)
 	_ = impl.rwc.Close()
 
-	timeoutChecker.Stop()
+	impl.sendQueue.close(ErrPeerClosed)
+
+	if errors.Is(reason, ErrKeepAliveTimeout) {
+		loge.Errorf(impl.ctx, "peer %v is dead: %v", impl.peerID, reason)
+	}
+	pongTimer.Stop()
 	pingTicker.Stop()
 
-	impl.closeOb.PeerClosed(impl)
+	impl.closeOb.PeerClosed(impl, reason)
+}
+
+// rateLimit applies the inbound limits to msg, it returns false if msg is dropped and an error
+// if the peer must be closed.
+func (impl *peerProxyImpl) rateLimit(msg Message) (bool, error) {
+	size := len(msg.Bytes())
+	if impl.limiter.action == RateLimitDelay {
+		wait := impl.limiter.wait(size)
+		if wait <= 0 {
+			return true, nil
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true, nil
+		case <-impl.chClosed:
+			return false, nil
+		}
+	}
+
+	result := impl.limiter.allow(size)
+	if result == rateLimitAllowed {
+		return true, nil
+	}
+	// the peer may be within its limit while the others use up the global one
+	if result == rateLimitPeerExceeded {
+		switch impl.limiter.action {
+		case RateLimitPenalize:
+			impl.misbehaviorOb.PeerMisbehaved(impl, MisbehaviorSpam)
+		case RateLimitDisconnect:
+			return false, rateLimitedError(impl.peerID, size)
+		}
+	}
+	loge.Debugf(impl.ctx, "peer %v message %v dropped: over rate limit", impl.peerID, msg.ID())
+	return false, nil
+}
+
+// write sends d within writeTimeout, the error wraps ErrWriteTimeout or ErrWriteFailed.
+func (impl *peerProxyImpl) write(d []byte) error {
+	err := impl.rwc.SetWriteDeadline(time.Now().Add(impl.writeTimeout))
+	if err == nil {
+		_, err = impl.rwc.Write(d)
+	}
+	if err == nil {
+		err = impl.rwc.Flush()
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("%w: %v", ErrWriteTimeout, err)
+		}
+		return fmt.Errorf("%w: %v", ErrWriteFailed, err)
+	}
+	_ = impl.rwc.SetWriteDeadline(time.Time{})
+	return nil
 }
 
 func (impl *peerProxyImpl) GetPeerID() string {
@@ -136,10 +356,81 @@ func (impl *peerProxyImpl) GetPeerID() string {
 }
 
 func (impl *peerProxyImpl) DoRequest(req Message) {
-	impl.ch2Write <- req
+	impl.Send(req, nil)
+}
+
+// priorityOf reserves PriorityControl for Control messages.
+func (impl *peerProxyImpl) priorityOf(msg Message) Priority {
+	if ctrlHelper, ok := impl.messageHelper.(ControlMessageHelper); ok && ctrlHelper.ParseControlMessage(msg) != nil {
+		return PriorityControl
+	}
+	pMsg, ok := msg.(PriorityMessage)
+	if !ok {
+		return PriorityNormal
+	}
+	if priority := pMsg.Priority(); priority < PriorityControl {
+		return priority
+	}
+	return PriorityHigh
+}
+
+func (impl *peerProxyImpl) Send(req Message, fnResult func(err error)) {
+	err := impl.sendQueue.push(&peerRequest{
+		msg:      req,
+		priority: impl.priorityOf(req),
+		fnResult: fnResult,
+	}, true)
+	if err != nil {
+		loge.Warnf(impl.ctx, "peer %v request dropped: %v", impl.peerID, err)
+	}
+}
+
+func (impl *peerProxyImpl) TrySend(req Message, fnResult func(err error)) error {
+	return impl.sendQueue.push(&peerRequest{
+		msg:      req,
+		priority: impl.priorityOf(req),
+		fnResult: fnResult,
+	}, false)
 }
 
 func (impl *peerProxyImpl) Disconnect() {
 	loge.Infof(impl.ctx, "peer %v disconnect", impl.peerID)
 	_ = impl.rwc.Close()
 }
+
+func (impl *peerProxyImpl) DisconnectWithReason(reason error) {
+	loge.Infof(impl.ctx, "peer %v disconnect: %v", impl.peerID, reason)
+	select {
+	case impl.chKick <- reason:
+	default:
+	}
+}
+
+func (impl *peerProxyImpl) GetInfo() PeerInfo {
+	impl.infoLock.Lock()
+	lastPong := impl.lastPong
+	rtt := impl.rtt.stats
+	impl.infoLock.Unlock()
+
+	return PeerInfo{
+		PeerID:           impl.peerID,
+		State:            PeerStateConnected,
+		Direction:        impl.direction,
+		RemoteAddrs:      []string{impl.rwc.RemoteAddr()},
+		ConnectedSince:   impl.connectedSince,
+		LastPong:         lastPong,
+		RTTStats:         rtt,
+		BytesSent:        atomic.LoadUint64(&impl.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&impl.bytesReceived),
+		MessagesSent:     atomic.LoadUint64(&impl.messagesSent),
+		MessagesReceived: atomic.LoadUint64(&impl.messagesReceived),
+		SendQueueLength:  impl.sendQueue.length(),
+	}
+}
+
+func (impl *peerProxyImpl) GetRTTStats() RTTStats {
+	impl.infoLock.Lock()
+	defer impl.infoLock.Unlock()
+
+	return impl.rtt.stats
+}
@@ -0,0 +1,141 @@
+package peer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// peerInfo returns what node reports of peerID, State is PeerStateIdle if it is not listed.
+func peerInfo(node *testNode, peerID string) PeerInfo {
+	ch := make(chan []PeerInfo, 1)
+	node.ListPeerInfos(func(infos []PeerInfo) {
+		ch <- infos
+	})
+	for _, info := range <-ch {
+		if info.PeerID == peerID {
+			return info
+		}
+	}
+	return PeerInfo{PeerID: peerID}
+}
+
+func TestPeerInfo(t *testing.T) {
+	fnConfig := func(cfg *Config) {
+		cfg.KeepAlive.PingInterval = time.Second
+	}
+	a := newTestNode(t, fnConfig)
+	b := newTestNode(t, fnConfig)
+	connectTestNodes(t, a, b)
+
+	info := peerInfo(a, b.GetID())
+	assert.Equal(t, PeerStateConnected, info.State)
+	assert.Equal(t, DirectionOutbound, info.Direction)
+	assert.NotEmpty(t, info.RemoteAddrs)
+	assert.False(t, info.ConnectedSince.IsZero())
+	// no ping has been answered yet
+	assert.True(t, info.LastPong.IsZero())
+	assert.Zero(t, info.RTTSamples)
+	assert.Equal(t, DirectionInbound, peerInfo(b, a.GetID()).Direction)
+
+	msg := a.newMessage(t, "counted")
+	sendAndWait(t, a, b.GetID(), msg, 1)
+	waitArrived(t, b)
+	assert.Eventually(t, func() bool {
+		info = peerInfo(a, b.GetID())
+		return !info.LastPong.IsZero()
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.False(t, info.LastPong.Before(info.ConnectedSince))
+	assert.NotZero(t, info.RTTSamples)
+	assert.NotZero(t, info.RTT)
+	assert.GreaterOrEqual(t, info.MessagesSent, uint64(2))
+	assert.GreaterOrEqual(t, info.BytesSent, uint64(len(msg.Bytes())))
+	assert.NotZero(t, info.MessagesReceived)
+}
+
+// waitPeerEvent returns the first event of type evType about peerID.
+func waitPeerEvent(t *testing.T, chEvents <-chan PeerEvent, evType PeerEventType, peerID string) PeerEvent {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-chEvents:
+			if ev.Type == evType && ev.PeerID == peerID {
+				return ev
+			}
+		case <-timeout:
+			assert.Failf(t, "no peer event", "%v of %v", evType, peerID)
+			return PeerEvent{}
+		}
+	}
+}
+
+func TestPeerKeepAliveTimeout(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.KeepAlive = KeepAlivePolicy{
+			PingInterval:   100 * time.Millisecond,
+			PongTimeout:    100 * time.Millisecond,
+			MaxMissedPongs: 1,
+		}
+	})
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	silentID, silentAddr := newSilentHost(t)
+	start := time.Now()
+	assert.Nil(t, a.dial(silentAddr))
+
+	ev := waitPeerEvent(t, chEvents, PeerDead, silentID)
+	assert.ErrorIs(t, ev.Reason, ErrKeepAliveTimeout)
+	// the second missed pong is one too many
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	ev = waitPeerEvent(t, chEvents, PeerDisconnected, silentID)
+	assert.ErrorIs(t, ev.Reason, ErrKeepAliveTimeout)
+	assert.NotContains(t, a.connectedPeers(), silentID)
+}
+
+func TestPeerWriteTimeout(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.WriteTimeout = time.Second
+	})
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	// the muxer buffers about 16MB of a stream the remote end doesn't read
+	const n = 32
+	payload := strings.Repeat("x", 1<<20)
+	msgs := make([]*ProtoMessage, 0, n)
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, a.newMessage(t, payload))
+	}
+
+	silentID, silentAddr := newSilentHost(t)
+	assert.Nil(t, a.dial(silentAddr))
+	// the messages are all queued before the timeout, one sent later would dial the peer again
+	chDelivery := make(chan error, n)
+	for _, msg := range msgs {
+		a.Send(silentID, msg, func(peerID string, err error) {
+			chDelivery <- err
+		})
+	}
+
+	ev := waitPeerEvent(t, chEvents, PeerDisconnected, silentID)
+	assert.ErrorIs(t, ev.Reason, ErrWriteTimeout)
+	var timeouts, closed int
+	for i := 0; i < n; i++ {
+		err := <-chDelivery
+		switch {
+		case errors.Is(err, ErrWriteTimeout):
+			timeouts++
+		case errors.Is(err, ErrPeerClosed):
+			closed++
+		default:
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, 1, timeouts)
+	assert.NotZero(t, closed)
+	assert.NotContains(t, a.connectedPeers(), silentID)
+}
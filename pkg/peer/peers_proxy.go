@@ -2,21 +2,63 @@ package peer
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/sgostarter/libp2p/pkg/acl"
 	"github.com/sgostarter/libp2p/pkg/bootstrap"
 	"github.com/sgostarter/libp2p/pkg/discovery"
 	"github.com/sgostarter/libp2p/pkg/p2pio"
+	"github.com/sgostarter/libp2p/pkg/talk"
 )
 
 type PeersProxy interface {
 	DoRequest(peerID string, req Message)
-	ListPeers(func(peerIDs []string))
+	// Send is DoRequest with a delivery report for every target peer, a broadcast (peerID == "")
+	// reports each connected peer, or ErrNoPeers if there is none. The peers a gossiped message
+	// is only announced to are reported with ErrAnnounced, see P2PConfig.GossipFanout.
+	Send(peerID string, req Message, fnResult DeliveryCallback)
+	// TrySend queues req for the connected peer peerID without waiting for room, it returns
+	// ErrSendQueueFull if the peer's send queue is full.
+	TrySend(peerID string, req Message) error
+	// Call sends req to peerID and waits for the ResponseMessage replying to it. It fails with
+	// the reason the peer is closed for if it disconnects first, and with ErrTimeout after
+	// P2PConfig.CallTimeout if ctx has no deadline.
+	Call(ctx context.Context, peerID string, req Message) (Message, error)
+	// ListPeers reports the connected peers followed by the idle discovered ones, only those
+	// selected by all the filters if any.
+	ListPeers(fn func(peerIDs []string), filters ...PeerFilter)
+	// ListPeerInfos reports the connected peers followed by the idle discovered ones, only
+	// those selected by all the filters if any.
+	ListPeerInfos(fn func(infos []PeerInfo), filters ...PeerFilter)
+	// Subscribe delivers the messages published to topic to handler instead of MessageArrivedOb,
+	// it needs a MessageHelper implementing MetaMessageHelper and ControlMessageHelper.
+	Subscribe(topic string, handler TopicHandler) error
+	Unsubscribe(topic string)
+	// Publish sends msg to the peers subscribing topic, which relay it to their subscribed peers.
+	Publish(topic string, msg Message) error
 	GetID() string
 	Wait4Ready()
+	SeenCacheStats() SeenCacheStats
+	// AddStickyPeer keeps reconnecting peerID whenever it drops, MaxConnectedPeers doesn't apply
+	// to sticky peers. P2PConfig.StickyPeers are sticky from the start.
+	AddStickyPeer(peerID string)
+	RemoveStickyPeer(peerID string)
+	// ACL returns the access list enforced on every peer, connected peers it denies are
+	// disconnected as soon as it changes.
+	ACL() *acl.ACL
+	// PeerScore returns the score of peerID, see ScorePolicy, and the end of its ban if it is banned.
+	PeerScore(peerID string) (score float64, bannedUntil time.Time)
+	// SubscribePeerEvents streams the peer lifecycle events, see PeerEventType.
+	SubscribePeerEvents(bufferSize int) (<-chan PeerEvent, func())
+	// Close stops discovery, disconnects all peers, closes the host and waits
+	// until every routine has exited or ctx is done.
+	Close(ctx context.Context) error
 }
 
-type peerInfo struct {
+type pmrPeer struct {
 	peer   PeerProxy
 	chExit chan interface{}
 }
@@ -25,16 +67,30 @@ func NewPeersProxy(ctx context.Context, cfg *Config) PeersProxy {
 	if cfg.MessageArrivedOb == nil || cfg.MessageHelper == nil {
 		return nil
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	peersACL := cfg.ACL
+	if peersACL == nil {
+		peersACL = acl.New()
+	}
 	peersProxy := &peersProxyImpl{
 		ctx:              ctx,
+		cancel:           cancel,
 		cfg:              cfg,
 		messageArrivedOb: cfg.MessageArrivedOb,
 		messageHelper:    cfg.MessageHelper,
-		pmr:              newPMR(),
-		pr:               newPR(),
+		pmr:              newPMR(&cfg.P2PConfig),
+		pr:               newPR(&cfg.P2PConfig),
+		calls:            newCallTable(),
+		topics:           make(map[string]TopicHandler),
+		events:           newEventBus(),
+		acl:              peersACL,
+		scores:           newScoreBoard(cfg.Score),
+		namespaces:       newPeerNamespaces(),
+		globalLimiter:    newRateLimiter(cfg.RateLimit.Global),
 		chInitComplete:   make(chan error, 10),
 	}
 
+	peersProxy.wg.Add(3)
 	go peersProxy.p2pDiscoveryRoutine()
 	go peersProxy.peersManagerRoutine()
 	go peersProxy.peersRoutine()
@@ -44,6 +100,8 @@ func NewPeersProxy(ctx context.Context, cfg *Config) PeersProxy {
 
 type peersProxyImpl struct {
 	ctx              context.Context
+	cancel           context.CancelFunc
+	wg               sync.WaitGroup
 	cfg              *Config
 	messageArrivedOb MessageArrivedObserver
 	messageHelper    MessageHelper
@@ -53,62 +111,217 @@ type peersProxyImpl struct {
 	// pr
 	pr *PR
 
+	calls *callTable
+
+	topicLock sync.RWMutex
+	topics    map[string]TopicHandler
+
+	events     *eventBus
+	acl        *acl.ACL
+	scores     *scoreBoard
+	namespaces *peerNamespaces
+
+	globalLimiter *rateLimiter
+
 	// p2p
 	host           interface{}
 	hostID         string
 	chInitComplete chan error
-
-	cachedPeerIDs []string
 }
 
 func (impl *peersProxyImpl) p2pDiscoveryRoutine() {
+	defer impl.wg.Done()
+
 	loge.Info(impl.ctx, "p2p discovery routine enter")
 	err := discovery.RunServer(impl.ctx, discovery.ServerParam{
 		HostParam: bootstrap.HostParam{
 			ListenPort: impl.cfg.ListenPort,
 		},
-		ProtocolID:       impl.cfg.ProtocolID,
-		BootstrapPeers:   impl.cfg.BootstrapPeers,
-		AdvertiseNS:      impl.cfg.AdvertiseNameSpace,
-		MinCheckInterval: 0,
+		ProtocolID:          impl.cfg.ProtocolID,
+		BootstrapPeers:      impl.cfg.BootstrapPeers,
+		AdvertiseNS:         impl.cfg.AdvertiseNameSpace,
+		MinCheckInterval:    0,
+		AdvertiseNamespaces: impl.cfg.AdvertiseNameSpaces,
+		LostGracePeriod:     impl.cfg.PeerLostGracePeriod,
+		DisableDHT:          impl.cfg.DisableDHT,
+		EnableMDNS:          impl.cfg.EnableMDNS,
+		MDNSServiceTag:      impl.cfg.MDNSServiceTag,
+		RendezvousPoints:    impl.cfg.RendezvousPoints,
+		Discoverers:         impl.cfg.Discoverers,
+		StreamFilter: func(peerID, remoteAddr string) error {
+			return impl.checkPeer(peerID, []string{remoteAddr})
+		},
 	}, impl)
 	if err != nil {
 		loge.Warnf(impl.ctx, "p2p discovery routine exit with error: %v", err)
 	}
+	impl.events.publish(PeerEvent{Type: ReadyStateChanged, Ready: false})
 	loge.Info(impl.ctx, "p2p discovery routine leave")
 }
 
-func (impl *peersProxyImpl) PeerClosed(peer PeerProxy) {
-	impl.pmr.chPeerClosed <- peer
+func (impl *peersProxyImpl) PeerClosed(peer PeerProxy, reason error) {
+	select {
+	case impl.pmr.chPeerClosed <- &pmrPeerClosed{
+		peer:   peer,
+		reason: reason,
+	}:
+	case <-impl.ctx.Done():
+	}
 }
 
 func (impl *peersProxyImpl) OnDataArrived(peer PeerProxy, req Message) {
+	if err := impl.scores.onMessage(peer.GetPeerID()); err != nil {
+		peer.DisconnectWithReason(err)
+		return
+	}
+	if impl.calls.resolve(peer.GetPeerID(), req) {
+		return
+	}
+	if ctrlHelper, ok := impl.messageHelper.(ControlMessageHelper); ok {
+		if ctrl := ctrlHelper.ParseControlMessage(req); ctrl != nil {
+			if ctrl.Kind < ControlSubscriptions || ctrl.Kind > ControlIWant {
+				impl.PeerMisbehaved(peer, MisbehaviorInvalidGossip)
+				return
+			}
+			impl.onControl(peer.GetPeerID(), ctrl)
+			return
+		}
+	}
+	if metaHelper, ok := impl.messageHelper.(MetaMessageHelper); ok {
+		meta := metaHelper.GetMessageMeta(req)
+		if (meta.Topic != "" || req.GossipFlag()) && (req.ID() == "" || meta.Hops < 0 || meta.Hops >= impl.gossipMaxHops()) {
+			// a well behaved peer doesn't relay a message that far
+			impl.PeerMisbehaved(peer, MisbehaviorInvalidGossip)
+			return
+		}
+		if topic := meta.Topic; topic != "" {
+			impl.onTopicMessage(peer.GetPeerID(), topic, req)
+			return
+		}
+	}
 	if req.GossipFlag() {
-		if !impl.pr.ec.Exists(req.ID()) {
-			impl.DoRequest("", req)
-			loge.Info(nil, "gossip request to other")
-		} else {
-			loge.Info(nil, "gossip already request")
+		if !impl.onGossip(peer.GetPeerID(), "", req) {
+			loge.Debug(nil, "gossip already request")
+			return
 		}
+		loge.Debug(nil, "gossip request to other")
 	}
 	impl.messageArrivedOb.OnDataArrived(peer.GetPeerID(), req)
 }
 
 func (impl *peersProxyImpl) DoRequest(peerID string, req Message) {
-	impl.pr.chDoRequest <- &prRequest{
-		peerID: peerID,
-		msg:    req,
+	impl.Send(peerID, req, nil)
+}
+
+func (impl *peersProxyImpl) Send(peerID string, req Message, fnResult DeliveryCallback) {
+	prReq := &prRequest{
+		peerID:   peerID,
+		msg:      req,
+		fnResult: fnResult,
+	}
+	select {
+	case impl.pr.chDoRequest <- prReq:
+	case <-impl.ctx.Done():
+		loge.Warnf(impl.ctx, "DoRequest %v dropped: peers proxy closed", peerID)
+		prReq.done(peerID, ErrClosed)
+	}
+}
+
+func (impl *peersProxyImpl) TrySend(peerID string, req Message) error {
+	if peerID == "" {
+		return ErrNoPeerID
+	}
+
+	chErr := make(chan error, 1)
+	impl.doAny(func() {
+		peer, ok := impl.pr.peers[peerID]
+		if !ok {
+			chErr <- fmt.Errorf("%w: %v", ErrPeerUnreachable, peerID)
+			return
+		}
+		chErr <- peer.TrySend(req, nil)
+	})
+
+	select {
+	case err := <-chErr:
+		return err
+	case <-impl.ctx.Done():
+		return ErrClosed
 	}
 }
 
-func (impl *peersProxyImpl) ListPeers(fn func(peerIDs []string)) {
-	impl.pr.chDoAny <- func() {
+func (impl *peersProxyImpl) ListPeers(fn func(peerIDs []string), filters ...PeerFilter) {
+	impl.doAny(func() {
+		if len(filters) > 0 {
+			infos := filterPeerInfos(impl.prPeerInfos(), filters)
+			peerIDs := make([]string, 0, len(infos))
+			for idx := range infos {
+				peerIDs = append(peerIDs, infos[idx].PeerID)
+			}
+			fn(peerIDs)
+			return
+		}
+
 		peerIDs := make([]string, 0, len(impl.pr.peers)+len(impl.pr.idlePeerIDs))
 		for peerID := range impl.pr.peers {
 			peerIDs = append(peerIDs, peerID)
 		}
 		peerIDs = append(peerIDs, impl.pr.idlePeerIDs...)
 		fn(peerIDs)
+	})
+}
+
+func (impl *peersProxyImpl) ListPeerInfos(fn func(infos []PeerInfo), filters ...PeerFilter) {
+	impl.doAny(func() {
+		fn(filterPeerInfos(impl.prPeerInfos(), filters))
+	})
+}
+
+func (impl *peersProxyImpl) prPeerInfos() []PeerInfo {
+	infos := make([]PeerInfo, 0, len(impl.pr.peers)+len(impl.pr.idlePeerIDs))
+	for _, peer := range impl.pr.peers {
+		info := peer.GetInfo()
+		info.Score, _ = impl.scores.score(info.PeerID)
+		info.Namespaces = impl.namespaces.get(info.PeerID)
+		infos = append(infos, info)
+	}
+	for _, peerID := range impl.pr.idlePeerIDs {
+		infos = append(infos, PeerInfo{
+			PeerID:      peerID,
+			State:       PeerStateIdle,
+			RemoteAddrs: talk.PeerAddrs(impl.host, peerID),
+			Namespaces:  impl.namespaces.get(peerID),
+		})
+	}
+	return infos
+}
+
+func (impl *peersProxyImpl) doAny(fn func()) {
+	select {
+	case impl.pr.chDoAny <- fn:
+	case <-impl.ctx.Done():
+	}
+}
+
+func (impl *peersProxyImpl) ACL() *acl.ACL {
+	return impl.acl
+}
+
+func (impl *peersProxyImpl) PeerScore(peerID string) (float64, time.Time) {
+	return impl.scores.score(peerID)
+}
+
+// checkPeer returns why peerID reached at addrs must not be connected.
+func (impl *peersProxyImpl) checkPeer(peerID string, addrs []string) error {
+	if err := impl.scores.checkBan(peerID); err != nil {
+		return err
+	}
+	return impl.acl.Check(peerID, addrs)
+}
+
+func (impl *peersProxyImpl) PeerMisbehaved(peer PeerProxy, misbehavior Misbehavior) {
+	if err := impl.scores.penalize(peer.GetPeerID(), misbehavior, 1); err != nil {
+		peer.DisconnectWithReason(err)
 	}
 }
 
@@ -116,11 +329,36 @@ func (impl *peersProxyImpl) GetID() string {
 	return impl.hostID
 }
 
+func (impl *peersProxyImpl) SeenCacheStats() SeenCacheStats {
+	return impl.pr.seenCache.getStats()
+}
+
 func (impl *peersProxyImpl) Wait4Ready() {
 	if impl.hostID != "" {
 		return
 	}
-	<-impl.chInitComplete
+	select {
+	case <-impl.chInitComplete:
+	case <-impl.ctx.Done():
+	}
+}
+
+func (impl *peersProxyImpl) Close(ctx context.Context) error {
+	impl.cancel()
+
+	chDone := make(chan interface{})
+	go func() {
+		impl.wg.Wait()
+		close(chDone)
+	}()
+
+	select {
+	case <-chDone:
+		impl.events.close()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 //
@@ -129,26 +367,46 @@ func (impl *peersProxyImpl) Wait4Ready() {
 func (impl *peersProxyImpl) NewHost(h interface{}, hID string) {
 	impl.host = h
 	impl.hostID = hID
+	if hostAware, ok := impl.messageHelper.(HostAwareMessageHelper); ok {
+		hostAware.SetHostID(hID)
+	}
 	impl.chInitComplete <- nil
+	impl.events.publish(PeerEvent{Type: ReadyStateChanged, Ready: true})
+
+	for _, addr := range impl.cfg.StaticPeers {
+		peerID, err := talk.AddPeerAddr(h, addr)
+		if err != nil {
+			loge.Errorf(impl.ctx, "invalid static peer %v: %v", addr, err)
+			continue
+		}
+		impl.AddStickyPeer(peerID)
+	}
 }
 
 func (impl *peersProxyImpl) StreamTalk(peerID string, rw *p2pio.ReadWriteCloser, chExit chan interface{}) {
-	impl.pmr.chNewActivePeer <- &pmrNewActivePeer{
+	select {
+	case impl.pmr.chNewActivePeer <- &pmrNewActivePeer{
 		peerID: peerID,
 		rw:     rw,
 		chExit: chExit,
+	}:
+	case <-impl.ctx.Done():
+		close(chExit)
 	}
 }
 
-func (impl *peersProxyImpl) OnNewPeerStart() {
-	impl.cachedPeerIDs = nil
-}
-
-func (impl *peersProxyImpl) OnNewPeer(peerID string) {
-	impl.cachedPeerIDs = append(impl.cachedPeerIDs, peerID)
+func (impl *peersProxyImpl) OnPeerFound(ev discovery.Event) {
+	impl.events.publish(PeerEvent{Type: PeerDiscovered, PeerID: ev.PeerID, Source: ev.Source, Namespace: ev.Namespace})
+	select {
+	case impl.pmr.chDiscovery <- ev:
+	case <-impl.ctx.Done():
+	}
 }
 
-func (impl *peersProxyImpl) OnNewPeerFinish() {
-	impl.pmr.chPeersListUpdate <- impl.cachedPeerIDs
-	impl.cachedPeerIDs = nil
+func (impl *peersProxyImpl) OnPeerLost(ev discovery.Event) {
+	impl.events.publish(PeerEvent{Type: PeerLost, PeerID: ev.PeerID, Source: ev.Source, Namespace: ev.Namespace})
+	select {
+	case impl.pmr.chDiscovery <- ev:
+	case <-impl.ctx.Done():
+	}
 }
@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultCallTimeout = 30 * time.Second
+
+type callResult struct {
+	resp Message
+	err  error
+}
+
+// callTable keeps the pending calls by peer, so that they fail as soon as their peer is gone.
+type callTable struct {
+	lock  sync.Mutex
+	calls map[string]map[string]chan callResult
+}
+
+func newCallTable() *callTable {
+	return &callTable{
+		calls: make(map[string]map[string]chan callResult),
+	}
+}
+
+func (ct *callTable) add(peerID, msgID string) (chan callResult, bool) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	peerCalls, ok := ct.calls[peerID]
+	if !ok {
+		peerCalls = make(map[string]chan callResult)
+		ct.calls[peerID] = peerCalls
+	}
+	if _, ok = peerCalls[msgID]; ok {
+		return nil, false
+	}
+	ch := make(chan callResult, 1)
+	peerCalls[msgID] = ch
+	return ch, true
+}
+
+func (ct *callTable) remove(peerID, msgID string) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	ct.removeLocked(peerID, msgID)
+}
+
+func (ct *callTable) removeLocked(peerID, msgID string) {
+	peerCalls, ok := ct.calls[peerID]
+	if !ok {
+		return
+	}
+	delete(peerCalls, msgID)
+	if len(peerCalls) == 0 {
+		delete(ct.calls, peerID)
+	}
+}
+
+// resolve hands resp to the pending call it answers, it returns false if resp is not a response
+// or nobody is waiting for it.
+func (ct *callTable) resolve(peerID string, resp Message) bool {
+	rm, ok := resp.(ResponseMessage)
+	if !ok || rm.ReplyTo() == "" {
+		return false
+	}
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	ch, ok := ct.calls[peerID][rm.ReplyTo()]
+	if !ok {
+		return false
+	}
+	ct.removeLocked(peerID, rm.ReplyTo())
+	ch <- callResult{resp: resp}
+	return true
+}
+
+// failPeer fails the pending calls to peerID with reason.
+func (ct *callTable) failPeer(peerID string, reason error) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	for _, ch := range ct.calls[peerID] {
+		ch <- callResult{err: reason}
+	}
+	delete(ct.calls, peerID)
+}
+
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+func (impl *peersProxyImpl) callTimeout() time.Duration {
+	if impl.cfg.CallTimeout > 0 {
+		return impl.cfg.CallTimeout
+	}
+	return defaultCallTimeout
+}
+
+// failCalls fails the pending calls to a peer closed for reason, a replaced peer keeps them
+// since the response may come on its new stream.
+func (impl *peersProxyImpl) failCalls(peerID string, reason error) {
+	if errors.Is(reason, ErrPeerReplaced) {
+		return
+	}
+	impl.calls.failPeer(peerID, reason)
+}
+
+func (impl *peersProxyImpl) Call(ctx context.Context, peerID string, req Message) (Message, error) {
+	if peerID == "" {
+		return nil, ErrNoPeerID
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, impl.callTimeout())
+		defer cancel()
+	}
+
+	chResp, ok := impl.calls.add(peerID, req.ID())
+	if !ok {
+		return nil, ErrDuplicateCall
+	}
+	defer impl.calls.remove(peerID, req.ID())
+
+	chSent := make(chan error, 1)
+	select {
+	case impl.pr.chDoRequest <- &prRequest{
+		peerID: peerID,
+		msg:    req,
+		fnResult: func(_ string, err error) {
+			chSent <- err
+		},
+	}:
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	case <-impl.ctx.Done():
+		return nil, ErrClosed
+	}
+
+	for {
+		select {
+		case err := <-chSent:
+			if err != nil {
+				return nil, err
+			}
+		case result := <-chResp:
+			return result.resp, result.err
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		case <-impl.ctx.Done():
+			return nil, ErrClosed
+		}
+	}
+}
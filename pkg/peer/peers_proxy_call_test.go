@@ -0,0 +1,131 @@
+package peer
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// newEchoNodes connects a caller to a node answering the messages starting with "echo".
+func newEchoNodes(t *testing.T, callTimeout time.Duration) (caller, echo *testNode) {
+	caller = newTestNode(t, func(cfg *Config) {
+		cfg.CallTimeout = callTimeout
+	})
+	echo = newTestNode(t, nil)
+	echo.ob.onData = func(peerID string, msg *ProtoMessage) {
+		if !strings.HasPrefix(payloadString(msg), "echo") {
+			return
+		}
+		resp, err := echo.helper.NewResponse(msg, wrapperspb.String("re:"+payloadString(msg)))
+		assert.Nil(t, err)
+		echo.DoRequest(peerID, resp)
+	}
+	connectTestNodes(t, caller, echo)
+	return caller, echo
+}
+
+func pendingCalls(node *testNode) int {
+	node.calls.lock.Lock()
+	defer node.calls.lock.Unlock()
+
+	n := 0
+	for _, peerCalls := range node.calls.calls {
+		n += len(peerCalls)
+	}
+	return n
+}
+
+func TestPeersProxyCall(t *testing.T) {
+	caller, echo := newEchoNodes(t, 0)
+
+	var wg sync.WaitGroup
+	for _, s := range []string{"echo 1", "echo 2", "echo 3", "echo 4"} {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			req := caller.newMessage(t, s)
+			resp, err := caller.Call(ctx, echo.GetID(), req)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, req.ID(), resp.(ResponseMessage).ReplyTo())
+			assert.Equal(t, "re:"+s, payloadString(resp.(*ProtoMessage)))
+		}(s)
+	}
+	wg.Wait()
+	assert.Zero(t, pendingCalls(caller))
+
+	_, err := caller.Call(context.Background(), "", caller.newMessage(t, "echo"))
+	assert.ErrorIs(t, err, ErrNoPeerID)
+}
+
+func TestPeersProxyCallTimeout(t *testing.T) {
+	caller, echo := newEchoNodes(t, 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := caller.Call(ctx, echo.GetID(), caller.newMessage(t, "silent"))
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// without a deadline CallTimeout applies
+	start := time.Now()
+	_, err = caller.Call(context.Background(), echo.GetID(), caller.newMessage(t, "silent"))
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.Zero(t, pendingCalls(caller))
+}
+
+func TestPeersProxyCallDuplicate(t *testing.T) {
+	caller, echo := newEchoNodes(t, 0)
+
+	req := caller.newMessage(t, "silent")
+	chErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		_, err := caller.Call(ctx, echo.GetID(), req)
+		chErr <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return pendingCalls(caller) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	_, err := caller.Call(context.Background(), echo.GetID(), req)
+	assert.ErrorIs(t, err, ErrDuplicateCall)
+	assert.ErrorIs(t, <-chErr, ErrTimeout)
+}
+
+func TestPeersProxyCallPeerClosed(t *testing.T) {
+	caller, echo := newEchoNodes(t, 0)
+
+	chErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := caller.Call(ctx, echo.GetID(), caller.newMessage(t, "silent"))
+		chErr <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return pendingCalls(caller) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(t, echo.Close(ctx))
+
+	select {
+	case err := <-chErr:
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, ErrTimeout)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "call not failed by the disconnection")
+	}
+	assert.Zero(t, pendingCalls(caller))
+}
@@ -0,0 +1,137 @@
+package peer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+)
+
+type PeerEventType int
+
+const (
+	PeerConnected PeerEventType = iota + 1
+	PeerDisconnected
+	PeerDiscovered
+	PeerLost
+	ReadyStateChanged
+	// PeerDead is emitted before the PeerDisconnected of a peer which failed the keepalive check
+	PeerDead
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "PeerConnected"
+	case PeerDisconnected:
+		return "PeerDisconnected"
+	case PeerDiscovered:
+		return "PeerDiscovered"
+	case PeerLost:
+		return "PeerLost"
+	case ReadyStateChanged:
+		return "ReadyStateChanged"
+	case PeerDead:
+		return "PeerDead"
+	default:
+		return "Unknown"
+	}
+}
+
+type PeerEvent struct {
+	Type   PeerEventType
+	PeerID string
+	// Reason is why the peer was disconnected or found dead
+	Reason error
+	// Ready is the new state of a ReadyStateChanged event
+	Ready bool
+	// Source is the discoverer which found or lost the peer of a PeerDiscovered or PeerLost
+	// event, Namespace is where. They are published for each namespace of the peer.
+	Source    string
+	Namespace string
+	Time      time.Time
+}
+
+const defaultPeerEventBufferSize = 64
+
+// eventBus fans peer events out to the subscribers without blocking the routines which emit
+// them, an event is dropped for a subscriber whose channel is full.
+type eventBus struct {
+	lock   sync.Mutex
+	nextID int
+	subs   map[int]chan PeerEvent
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[int]chan PeerEvent),
+	}
+}
+
+func (bus *eventBus) subscribe(bufferSize int) (<-chan PeerEvent, func()) {
+	if bufferSize <= 0 {
+		bufferSize = defaultPeerEventBufferSize
+	}
+	ch := make(chan PeerEvent, bufferSize)
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := bus.nextID
+	bus.nextID++
+	bus.subs[id] = ch
+
+	return ch, func() {
+		bus.lock.Lock()
+		defer bus.lock.Unlock()
+
+		if ch, ok := bus.subs[id]; ok {
+			delete(bus.subs, id)
+			close(ch)
+		}
+	}
+}
+
+func (bus *eventBus) publish(evt PeerEvent) {
+	evt.Time = time.Now()
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	for _, ch := range bus.subs {
+		select {
+		case ch <- evt:
+		default:
+			loge.Warnf(nil, "peer event %v of %v dropped: subscriber is full", evt.Type, evt.PeerID)
+		}
+	}
+}
+
+func (bus *eventBus) close() {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.closed = true
+	for id, ch := range bus.subs {
+		delete(bus.subs, id)
+		close(ch)
+	}
+}
+
+// SubscribePeerEvents returns a channel of the peer events and the function which cancels the
+// subscription, the channel is closed on cancel or when the peers proxy is closed. ListPeers
+// lists a peer once its PeerConnected is published, and no more once its PeerDisconnected is.
+func (impl *peersProxyImpl) SubscribePeerEvents(bufferSize int) (<-chan PeerEvent, func()) {
+	return impl.events.subscribe(bufferSize)
+}
+
+func (impl *peersProxyImpl) publishEvents(events []PeerEvent) {
+	for _, evt := range events {
+		impl.events.publish(evt)
+	}
+}
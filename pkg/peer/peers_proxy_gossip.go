@@ -0,0 +1,231 @@
+package peer
+
+import (
+	"container/list"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+)
+
+const (
+	defaultGossipMaxHops     = 8
+	defaultGossipHistorySize = 1000
+	defaultGossipHistoryTTL  = 2 * time.Minute
+	// maxWireHops caps the hops a peer sends, so that a huge value doesn't wrap into a negative
+	// int but is over any GossipMaxHops
+	maxWireHops = math.MaxInt32
+)
+
+// wireHops converts the hops read from a message.
+func wireHops(hops uint64) int {
+	if hops > maxWireHops {
+		return maxWireHops
+	}
+	return int(hops)
+}
+
+type gossipHistoryEntry struct {
+	msg Message
+	at  time.Time
+}
+
+// gossipHistory keeps the lazily pushed messages to answer IWANT, it is owned by the peers routine.
+type gossipHistory struct {
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newGossipHistory(capacity int, ttl time.Duration) *gossipHistory {
+	if capacity <= 0 {
+		capacity = defaultGossipHistorySize
+	}
+	if ttl <= 0 {
+		ttl = defaultGossipHistoryTTL
+	}
+	return &gossipHistory{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (h *gossipHistory) expire(now time.Time) {
+	for e := h.order.Front(); e != nil; e = h.order.Front() {
+		if now.Sub(e.Value.(*gossipHistoryEntry).at) < h.ttl && h.order.Len() <= h.capacity {
+			return
+		}
+		delete(h.entries, e.Value.(*gossipHistoryEntry).msg.ID())
+		h.order.Remove(e)
+	}
+}
+
+func (h *gossipHistory) add(msg Message) {
+	if _, ok := h.entries[msg.ID()]; ok {
+		return
+	}
+	h.entries[msg.ID()] = h.order.PushBack(&gossipHistoryEntry{
+		msg: msg,
+		at:  time.Now(),
+	})
+	h.expire(time.Now())
+}
+
+func (h *gossipHistory) get(msgID string) Message {
+	h.expire(time.Now())
+	if e, ok := h.entries[msgID]; ok {
+		return e.Value.(*gossipHistoryEntry).msg
+	}
+	return nil
+}
+
+func (impl *peersProxyImpl) gossipMaxHops() int {
+	if impl.cfg.GossipMaxHops > maxWireHops {
+		return maxWireHops
+	}
+	if impl.cfg.GossipMaxHops > 0 {
+		return impl.cfg.GossipMaxHops
+	}
+	return defaultGossipMaxHops
+}
+
+// onGossip relays a gossiped message the first time it arrives and reports whether it is new.
+func (impl *peersProxyImpl) onGossip(peerID, topic string, msg Message) bool {
+	if impl.pr.seen(msg.ID()) {
+		return false
+	}
+
+	relayMsg := msg
+	if metaHelper, ok := impl.messageHelper.(MetaMessageHelper); ok {
+		meta := metaHelper.GetMessageMeta(msg)
+		meta.Hops++
+		if meta.Hops >= impl.gossipMaxHops() {
+			loge.Debugf(impl.ctx, "gossip %v from %v reached max hops", msg.ID(), peerID)
+			return true
+		}
+		var err error
+		if relayMsg, err = metaHelper.SetMessageMeta(msg, meta); err != nil {
+			loge.Errorf(impl.ctx, "gossip %v set hops failed: %v", msg.ID(), err)
+			return true
+		}
+	}
+
+	select {
+	case impl.pr.chDoRequest <- &prRequest{
+		msg:        relayMsg,
+		topic:      topic,
+		fromPeerID: peerID,
+	}:
+	case <-impl.ctx.Done():
+	}
+	return true
+}
+
+func (impl *peersProxyImpl) onIHave(peerID string, msgIDs []string) {
+	ctrlHelper, ok := impl.messageHelper.(ControlMessageHelper)
+	if !ok {
+		return
+	}
+	wants := make([]string, 0, len(msgIDs))
+	for _, msgID := range msgIDs {
+		if !impl.pr.seenCache.contains(msgID) {
+			wants = append(wants, msgID)
+		}
+	}
+	if len(wants) == 0 {
+		return
+	}
+	msg, err := ctrlHelper.CreateControlMessage(&Control{
+		Kind: ControlIWant,
+		IDs:  wants,
+	})
+	if err != nil {
+		loge.Errorf(impl.ctx, "create iwant message failed: %v", err)
+		return
+	}
+	impl.doAny(func() {
+		if peer, ok := impl.pr.peers[peerID]; ok {
+			peer.DoRequest(msg)
+		}
+	})
+}
+
+func (impl *peersProxyImpl) onIWant(peerID string, msgIDs []string) {
+	impl.doAny(func() {
+		peer, ok := impl.pr.peers[peerID]
+		if !ok {
+			return
+		}
+		for _, msgID := range msgIDs {
+			if msg := impl.pr.history.get(msgID); msg != nil {
+				peer.DoRequest(msg)
+			}
+		}
+	})
+}
+
+// pickEagerPeers shuffles peers so that the first ones are a weighted random sample, a peer
+// with a lower RTT is more likely to come first but any peer may.
+func pickEagerPeers(peers []PeerProxy) {
+	// Efraimidis-Spirakis sampling without replacement, the peers are ordered by u^(1/weight)
+	keys := make(map[PeerProxy]float64, len(peers))
+	for _, peer := range peers {
+		keys[peer] = math.Pow(rand.Float64(), 1/rttWeight(peer.GetRTTStats()))
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return keys[peers[i]] > keys[peers[j]]
+	})
+}
+
+// prGossip pushes the message to GossipFanout random peers and announces it to the others
+// with IHAVE, they fetch it with IWANT if no eager peer relays it to them first.
+func (impl *peersProxyImpl) prGossip(req *prRequest, peers []PeerProxy) {
+	fanout := impl.cfg.GossipFanout
+	ctrlHelper, ok := impl.messageHelper.(ControlMessageHelper)
+	if fanout <= 0 || len(peers) <= fanout || !ok {
+		for _, peer := range peers {
+			impl.prSendToPeer(peer, req)
+		}
+		return
+	}
+
+	ihave, err := ctrlHelper.CreateControlMessage(&Control{
+		Kind: ControlIHave,
+		IDs:  []string{req.msg.ID()},
+	})
+	if err != nil {
+		loge.Errorf(impl.ctx, "create ihave message failed: %v", err)
+		for _, peer := range peers {
+			impl.prSendToPeer(peer, req)
+		}
+		return
+	}
+
+	pickEagerPeers(peers)
+	for _, peer := range peers[:fanout] {
+		impl.prSendToPeer(peer, req)
+	}
+	impl.pr.history.add(req.msg)
+	for _, peer := range peers[fanout:] {
+		impl.prSendMessageToPeer(peer, ihave, announcedResult(req.fnResult))
+	}
+}
+
+// announcedResult reports the peers which only got the IHAVE of a message with ErrAnnounced,
+// the message itself was not written to them.
+func announcedResult(fnResult DeliveryCallback) DeliveryCallback {
+	if fnResult == nil {
+		return nil
+	}
+	return func(peerID string, err error) {
+		if err == nil {
+			err = ErrAnnounced
+		}
+		fnResult(peerID, err)
+	}
+}
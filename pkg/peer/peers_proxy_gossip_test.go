@@ -0,0 +1,164 @@
+package peer
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// arrivedIDs collects the IDs of the messages delivered to node until it is quiet for a while.
+func arrivedIDs(node *testNode) []string {
+	var ids []string
+	for {
+		select {
+		case arrived := <-node.ob.chArrived:
+			ids = append(ids, arrived.msg.ID())
+		case <-time.After(300 * time.Millisecond):
+			return ids
+		}
+	}
+}
+
+func newGossipMessage(t *testing.T, node *testNode, s string) *ProtoMessage {
+	msg, err := node.helper.NewGossipMessage(wrapperspb.String(s))
+	assert.Nil(t, err)
+	return msg
+}
+
+func TestPeersProxyGossipOnce(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+	connectTestNodes(t, a, b)
+	connectTestNodes(t, b, c)
+	connectTestNodes(t, c, a)
+
+	msg := newGossipMessage(t, a, "rumor")
+	a.DoRequest("", msg)
+	// b and c get it from a and from each other, the application sees it once
+	assert.Equal(t, []string{msg.ID()}, arrivedIDs(b))
+	assert.Equal(t, []string{msg.ID()}, arrivedIDs(c))
+	assert.Empty(t, arrivedIDs(a))
+
+	// b and c miss the first copy and hit the one relayed by the other, a is not sent any
+	for _, node := range []*testNode{b, c} {
+		stats := node.SeenCacheStats()
+		assert.EqualValues(t, 1, stats.Hits)
+		assert.EqualValues(t, 1, stats.Misses)
+		assert.InDelta(t, 0.5, stats.HitRate(), 0.0001)
+	}
+	stats := a.SeenCacheStats()
+	assert.Zero(t, stats.Hits)
+	assert.Zero(t, stats.Misses)
+	assert.Equal(t, 1, stats.Size)
+}
+
+func TestPeersProxyGossipMaxHops(t *testing.T) {
+	fnConfig := func(cfg *Config) {
+		cfg.GossipMaxHops = 1
+		cfg.Score.Enabled = true
+	}
+	a := newTestNode(t, fnConfig)
+	b := newTestNode(t, fnConfig)
+	c := newTestNode(t, fnConfig)
+	connectTestNodes(t, a, b)
+	connectTestNodes(t, b, c)
+
+	// b is one hop away from a, it doesn't relay to c
+	msg := newGossipMessage(t, a, "short")
+	a.DoRequest("", msg)
+	assert.Equal(t, []string{msg.ID()}, arrivedIDs(b))
+	assert.Empty(t, arrivedIDs(c))
+	score, _ := b.PeerScore(a.GetID())
+	assert.Zero(t, score)
+}
+
+func TestPeersProxyGossipHopsOverflow(t *testing.T) {
+	fnConfig := func(cfg *Config) {
+		cfg.Score.Enabled = true
+	}
+	a := newTestNode(t, fnConfig)
+	b := newTestNode(t, fnConfig)
+	c := newTestNode(t, fnConfig)
+	connectTestNodes(t, a, b)
+	connectTestNodes(t, b, c)
+
+	// hops which would wrap into a negative int are over the max
+	msg := *newGossipMessage(t, a, "wrapped")
+	msg.hops = math.MaxUint64
+	wrapped, err := a.helper.buildMessage(&msg)
+	assert.Nil(t, err)
+	assert.Equal(t, maxWireHops, a.helper.GetMessageMeta(wrapped).Hops)
+	a.DoRequest(b.GetID(), wrapped)
+	assert.Empty(t, arrivedIDs(b))
+	assert.Empty(t, arrivedIDs(c))
+	score, _ := b.PeerScore(a.GetID())
+	assert.Less(t, score, float64(0))
+}
+
+func TestPeersProxyGossipLazyPush(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.GossipFanout = 1
+	})
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+	connectTestNodes(t, a, b)
+	connectTestNodes(t, a, c)
+
+	// one of b and c gets the message pushed, the other one only gets IHAVE and fetches it
+	// with IWANT since nobody relays it
+	msg := newGossipMessage(t, a, "lazy")
+	deliveries := sendAndWait(t, a, "", msg, 2)
+	if assert.Len(t, deliveries, 2) {
+		assert.ElementsMatch(t, []string{b.GetID(), c.GetID()},
+			[]string{deliveries[0].peerID, deliveries[1].peerID})
+		var errs []error
+		for _, delivery := range deliveries {
+			if delivery.err != nil {
+				errs = append(errs, delivery.err)
+			}
+		}
+		if assert.Len(t, errs, 1) {
+			assert.ErrorIs(t, errs[0], ErrAnnounced)
+		}
+	}
+	assert.Equal(t, []string{msg.ID()}, arrivedIDs(b))
+	assert.Equal(t, []string{msg.ID()}, arrivedIDs(c))
+
+	chInHistory := make(chan bool, 1)
+	a.doAny(func() {
+		chInHistory <- a.pr.history.get(msg.ID()) != nil
+	})
+	assert.True(t, <-chInHistory)
+}
+
+type testRTTPeer struct {
+	PeerProxy
+	id  string
+	rtt RTTStats
+}
+
+func (peer *testRTTPeer) GetRTTStats() RTTStats {
+	return peer.rtt
+}
+
+func TestPickEagerPeers(t *testing.T) {
+	fast := &testRTTPeer{id: "fast", rtt: RTTStats{RTT: time.Millisecond, RTTSamples: 1}}
+	slow := &testRTTPeer{id: "slow", rtt: RTTStats{RTT: 500 * time.Millisecond, RTTSamples: 1}}
+	unknown := &testRTTPeer{id: "unknown"}
+
+	picked := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		peers := []PeerProxy{slow, unknown, fast}
+		pickEagerPeers(peers)
+		assert.ElementsMatch(t, []PeerProxy{slow, unknown, fast}, peers)
+		picked[peers[0].(*testRTTPeer).id]++
+	}
+	// the closer a peer the more often it is picked, but every peer is
+	assert.Greater(t, picked["fast"], picked["unknown"])
+	assert.Greater(t, picked["unknown"], picked["slow"])
+	assert.NotZero(t, picked["slow"])
+}
@@ -2,9 +2,11 @@ package peer
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/sgostarter/libp2p/pkg/discovery"
 	"github.com/sgostarter/libp2p/pkg/p2pio"
 	"github.com/sgostarter/libp2p/pkg/talk"
 )
@@ -15,31 +17,66 @@ type pmrNewActivePeer struct {
 	chExit chan interface{}
 }
 
+type pmrPeerClosed struct {
+	peer   PeerProxy
+	reason error
+}
+
 type PMR struct {
-	peers             map[string]*peerInfo
-	peerIdleIDs       map[string]interface{}
-	chPeerClosed      chan PeerProxy
-	chPeersListUpdate chan []string
-	chNewActivePeer   chan *pmrNewActivePeer
-	chDoSlowRequest   chan *prRequest
+	peers           map[string]*pmrPeer
+	peerIdleIDs     map[string]interface{}
+	discoveredIDs   map[string]interface{}
+	chPeerClosed    chan *pmrPeerClosed
+	chDiscovery     chan discovery.Event
+	chNewActivePeer chan *pmrNewActivePeer
+	chDoSlowRequest chan *prRequest
+	chDoAny         chan func()
+
+	stickyIDs       map[string]interface{}
+	reconnects      map[string]*pmrReconnect
+	reconnectPolicy ReconnectPolicy
+	reconnectTimer  *time.Timer
+}
+
+func newPMR(cfg *P2PConfig) *PMR {
+	pmr := &PMR{
+		peers:           make(map[string]*pmrPeer),
+		peerIdleIDs:     make(map[string]interface{}),
+		discoveredIDs:   make(map[string]interface{}),
+		chPeerClosed:    make(chan *pmrPeerClosed, 2),
+		chDiscovery:     make(chan discovery.Event, 16),
+		chNewActivePeer: make(chan *pmrNewActivePeer),
+		chDoSlowRequest: make(chan *prRequest),
+		chDoAny:         make(chan func()),
+		stickyIDs:       make(map[string]interface{}),
+		reconnects:      make(map[string]*pmrReconnect),
+		reconnectPolicy: cfg.Reconnect.withDefaults(),
+		reconnectTimer:  time.NewTimer(time.Hour),
+	}
+	pmr.reconnectTimer.Stop()
+	for _, peerID := range cfg.StickyPeers {
+		pmr.stickyIDs[peerID] = true
+		pmr.reconnects[peerID] = &pmrReconnect{}
+	}
+	return pmr
 }
 
-func newPMR() *PMR {
-	return &PMR{
-		peers:             make(map[string]*peerInfo),
-		peerIdleIDs:       make(map[string]interface{}),
-		chPeerClosed:      make(chan PeerProxy, 2),
-		chPeersListUpdate: make(chan []string, 2),
-		chNewActivePeer:   make(chan *pmrNewActivePeer),
-		chDoSlowRequest:   make(chan *prRequest),
+func (impl *peersProxyImpl) pmrDoAny(fn func()) {
+	select {
+	case impl.pmr.chDoAny <- fn:
+	case <-impl.ctx.Done():
 	}
 }
 
 func (impl *peersProxyImpl) peersManagerRoutine() {
+	defer impl.wg.Done()
+
 	loge.Info(impl.ctx, "peers manager routine enter")
 
 	idleTimeout := 2 * time.Minute
 	idleTicker := time.NewTicker(idleTimeout)
+	impl.pmrResetReconnectTimer()
+	chACLChanged := impl.acl.Changed()
 
 	loop := true
 	for loop {
@@ -50,71 +87,113 @@ func (impl *peersProxyImpl) peersManagerRoutine() {
 			loge.Debug(nil, "peersManagerRoutine regular peers begin")
 			impl.pmrRegularPeers()
 			loge.Debug(nil, "peersManagerRoutine regular peers end")
-		case peerIDs := <-impl.pmr.chPeersListUpdate:
-			if len(impl.pmr.chPeersListUpdate) > 0 {
-				continue
-			}
-			loge.Debug(nil, "peersManagerRoutine list update begin")
-			newPeerIDs := make(map[string]interface{})
-			for _, peerID := range peerIDs {
-				newPeerIDs[peerID] = true
-			}
-			// remove the invalid peers
-			for peerID := range impl.pmr.peers {
-				if _, ok := newPeerIDs[peerID]; !ok {
-					impl.pmrRemovePeer(peerID)
-				} else {
-					delete(newPeerIDs, peerID)
+		case ev := <-impl.pmr.chDiscovery:
+			loge.Debug(nil, "peersManagerRoutine discovery begin")
+			// a peer is found by its first namespace and lost with its last one
+			if ev.Lost {
+				if impl.namespaces.remove(ev.PeerID, ev.Namespace) {
+					impl.pmrPeerLost(ev.PeerID)
 				}
+			} else if impl.namespaces.add(ev.PeerID, ev.Namespace) {
+				impl.pmrPeerFound(ev.PeerID)
 			}
-			impl.pmr.peerIdleIDs = newPeerIDs
-			impl.pmrUpdateIdlePeerIDs()
-			impl.pmrRegularPeers()
-
-			idleTicker.Reset(idleTimeout)
-
-			loge.Debug(nil, "peersManagerRoutine list update end")
-		case peer := <-impl.pmr.chPeerClosed:
+			loge.Debug(nil, "peersManagerRoutine discovery end")
+		case closed := <-impl.pmr.chPeerClosed:
 			loge.Debug(nil, "peersManagerRoutine peer close begin")
-			if oPeer, ok := impl.pmr.peers[peer.GetPeerID()]; ok {
-				if oPeer.peer != peer {
+			if oPeer, ok := impl.pmr.peers[closed.peer.GetPeerID()]; ok {
+				if oPeer.peer != closed.peer {
 					continue
 				}
 			}
-			impl.pmrRemovePeer(peer.GetPeerID())
+			impl.pmrRemovePeer(closed.peer.GetPeerID(), closed.reason)
+			impl.pmrRegularPeers()
 			loge.Debug(nil, "peersManagerRoutine peer close end")
 		case aPeer := <-impl.pmr.chNewActivePeer:
 			loge.Debug(nil, "peersManagerRoutine new active peer begin")
-			impl.pmrAddPeer(aPeer.peerID, aPeer.chExit, aPeer.rw)
+			impl.pmrAddPeer(aPeer.peerID, DirectionInbound, aPeer.chExit, aPeer.rw)
 			loge.Debug(nil, "peersManagerRoutine new active peer end")
 		case req := <-impl.pmr.chDoSlowRequest:
 			loge.Debug(nil, "peersManagerRoutine do slow request begin")
 			impl.pmrDoRequest(req)
 			loge.Debug(nil, "peersManagerRoutine do slow request end")
+		case <-impl.pmr.reconnectTimer.C:
+			loge.Debug(nil, "peersManagerRoutine reconnect begin")
+			impl.pmrReconnectDue()
+			loge.Debug(nil, "peersManagerRoutine reconnect end")
+		case fn := <-impl.pmr.chDoAny:
+			fn()
+		case <-chACLChanged:
+			chACLChanged = impl.acl.Changed()
+			impl.pmrCheckACL()
 		}
 	}
 
+	idleTicker.Stop()
+	impl.pmr.reconnectTimer.Stop()
+	for peerID := range impl.pmr.peers {
+		impl.pmrRemovePeer(peerID, ErrClosed)
+	}
+
 	loge.Info(impl.ctx, "peers manager routine leave")
 }
 
+// pmrPeerFound connects a newly discovered peer if there is room for it, it is kept idle
+// otherwise.
+func (impl *peersProxyImpl) pmrPeerFound(peerID string) {
+	impl.pmr.discoveredIDs[peerID] = true
+	if _, ok := impl.pmr.peers[peerID]; ok {
+		return
+	}
+	if _, ok := impl.pmr.reconnects[peerID]; ok {
+		return
+	}
+
+	if impl.cfg.MaxConnectedPeers <= 0 || impl.pmrRegularPeerCount() < impl.cfg.MaxConnectedPeers {
+		if _, err := impl.pmrConnect(peerID); err == nil {
+			return
+		}
+	}
+	impl.pmr.peerIdleIDs[peerID] = true
+	impl.pmrUpdateIdlePeerIDs()
+}
+
+// pmrPeerLost forgets a peer the discovery lost, a live session with it is kept.
+func (impl *peersProxyImpl) pmrPeerLost(peerID string) {
+	delete(impl.pmr.discoveredIDs, peerID)
+	if _, ok := impl.pmr.stickyIDs[peerID]; !ok {
+		delete(impl.pmr.reconnects, peerID)
+	}
+	if _, ok := impl.pmr.peerIdleIDs[peerID]; ok {
+		delete(impl.pmr.peerIdleIDs, peerID)
+		impl.pmrUpdateIdlePeerIDs()
+	}
+}
+
 func (impl *peersProxyImpl) pmrUpdateIdlePeerIDs() {
 	ids := make([]string, 0, len(impl.pmr.peerIdleIDs))
 	for peerID := range impl.pmr.peerIdleIDs {
 		ids = append(ids, peerID)
 	}
-	impl.pr.chUpdateIdleIDs <- ids
+	select {
+	case impl.pr.chUpdateIdleIDs <- ids:
+	case <-impl.ctx.Done():
+	}
 }
 
 func (impl *peersProxyImpl) pmrDoRequest(req *prRequest) {
 	req.executeCnt++
-	if _, ok := impl.pr.peers[req.peerID]; ok {
-		impl.pr.chDoRequest <- req
-	} else {
-		_, err := impl.pmrConnect(req.peerID)
-		if err == nil {
-			impl.pr.chDoRequest <- req
+	if _, ok := impl.pmr.peers[req.peerID]; !ok {
+		if _, err := impl.pmrConnect(req.peerID); err != nil {
+			loge.Warnf(impl.ctx, "pmrDoRequest connect %v failed: %v", req.peerID, err)
+			req.done(req.peerID, fmt.Errorf("%w: %v", ErrPeerUnreachable, err))
+			return
 		}
 	}
+	select {
+	case impl.pr.chDoRequest <- req:
+	case <-impl.ctx.Done():
+		req.done(req.peerID, ErrClosed)
+	}
 }
 
 func (impl *peersProxyImpl) pmrRegularPeers() {
@@ -124,10 +203,11 @@ func (impl *peersProxyImpl) pmrRegularPeers() {
 
 	cnt := len(impl.pmr.peerIdleIDs)
 	if impl.cfg.P2PConfig.MaxConnectedPeers > 0 {
-		if len(impl.pmr.peers) >= impl.cfg.P2PConfig.MaxConnectedPeers {
+		connected := impl.pmrRegularPeerCount()
+		if connected >= impl.cfg.P2PConfig.MaxConnectedPeers {
 			return
 		}
-		cnt = impl.cfg.P2PConfig.MaxConnectedPeers - len(impl.pmr.peers)
+		cnt = impl.cfg.P2PConfig.MaxConnectedPeers - connected
 	}
 	for peerID := range impl.pmr.peerIdleIDs {
 		_, err := impl.pmrConnect(peerID)
@@ -143,49 +223,114 @@ func (impl *peersProxyImpl) pmrRegularPeers() {
 	impl.pmrUpdateIdlePeerIDs()
 }
 
+// pmrRegularPeerCount counts the connected peers which are not sticky, MaxConnectedPeers
+// only limits them.
+func (impl *peersProxyImpl) pmrRegularPeerCount() int {
+	cnt := 0
+	for peerID := range impl.pmr.peers {
+		if _, ok := impl.pmr.stickyIDs[peerID]; !ok {
+			cnt++
+		}
+	}
+	return cnt
+}
+
 // nolint: unparam
 func (impl *peersProxyImpl) pmrConnect(peerID string) (PeerProxy, error) {
 	if peerID == "" {
 		return nil, errors.New("no peer id")
 	}
-	if peerInfo, ok := impl.pmr.peers[peerID]; ok {
-		return peerInfo.peer, nil
+	if mPeer, ok := impl.pmr.peers[peerID]; ok {
+		return mPeer.peer, nil
+	}
+	if err := impl.checkPeer(peerID, talk.PeerAddrs(impl.host, peerID)); err != nil {
+		return nil, err
 	}
 	err := talk.Start(impl.ctx, impl.host, peerID, impl.cfg.ProtocolID, func(peerID string, rw *p2pio.ReadWriteCloser, chExit chan interface{}) {
-		impl.pmrAddPeer(peerID, chExit, rw)
+		impl.pmrAddPeer(peerID, DirectionOutbound, chExit, rw)
 	})
 	if err != nil {
 		return nil, err
 	}
-	if peerInfo, ok := impl.pmr.peers[peerID]; ok {
-		return peerInfo.peer, nil
+	if mPeer, ok := impl.pmr.peers[peerID]; ok {
+		return mPeer.peer, nil
 	}
 	return nil, errors.New("no peer")
 }
 
-func (impl *peersProxyImpl) pmrAddPeer(peerID string, chExit chan interface{}, rwc *p2pio.ReadWriteCloser) {
-	impl.pmrRemovePeer(peerID)
-
-	keepAlive := impl.cfg.KeepAliveDuration
-	if keepAlive <= 0 {
-		keepAlive = 10 * time.Minute
+func (impl *peersProxyImpl) pmrAddPeer(peerID string, direction PeerDirection, chExit chan interface{}, rwc *p2pio.ReadWriteCloser) {
+	if err := impl.checkPeer(peerID, []string{rwc.RemoteAddr()}); err != nil {
+		loge.Warnf(impl.ctx, "peer %v rejected: %v", peerID, err)
+		close(chExit)
+		return
 	}
-	impl.pmr.peers[peerID] = &peerInfo{
-		peer:   newPeerProxy(impl.ctx, peerID, rwc, impl, impl, impl.messageHelper, keepAlive),
+	impl.pmrRemovePeer(peerID, ErrPeerReplaced)
+
+	keepAlive := impl.cfg.KeepAlive.withDefaults(impl.cfg.KeepAliveDuration)
+	limiter := newInboundLimiter(impl.cfg.RateLimit.Action, newRateLimiter(impl.cfg.RateLimit.PerPeer), impl.globalLimiter)
+	impl.pmr.peers[peerID] = &pmrPeer{
+		peer: newPeerProxy(impl.ctx, &impl.wg, peerID, direction, rwc, impl, impl, impl, impl.messageHelper,
+			keepAlive, impl.cfg.SendQueue, impl.cfg.WriteTimeout, limiter),
 		chExit: chExit,
 	}
-	impl.pr.chAddPeer <- impl.pmr.peers[peerID].peer
+	if _, ok := impl.pmr.peerIdleIDs[peerID]; ok {
+		delete(impl.pmr.peerIdleIDs, peerID)
+		impl.pmrUpdateIdlePeerIDs()
+	}
+	impl.pmrChangePeer(impl.pr.chAddPeer, impl.pmr.peers[peerID].peer,
+		PeerEvent{Type: PeerConnected, PeerID: peerID})
 }
 
-func (impl *peersProxyImpl) pmrRemovePeer(peerID string) {
-	peerInfo, ok := impl.pmr.peers[peerID]
+// pmrChangePeer hands the change of peer to pr, which publishes events once it is applied. They
+// are published right away if the proxy is closing.
+func (impl *peersProxyImpl) pmrChangePeer(ch chan *prPeerChange, peer PeerProxy, events ...PeerEvent) {
+	select {
+	case ch <- &prPeerChange{peer: peer, events: events}:
+	case <-impl.ctx.Done():
+		impl.publishEvents(events)
+	}
+}
+
+func (impl *peersProxyImpl) pmrRemovePeer(peerID string, reason error) {
+	mPeer, ok := impl.pmr.peers[peerID]
 	if !ok {
 		return
 	}
 
-	peerInfo.peer.Disconnect()
+	mPeer.peer.Disconnect()
 	delete(impl.pmr.peers, peerID)
-	peerInfo.chExit <- true
+	mPeer.chExit <- true
+
+	impl.failCalls(peerID, reason)
+	var events []PeerEvent
+	if errors.Is(reason, ErrKeepAliveTimeout) {
+		events = append(events, PeerEvent{Type: PeerDead, PeerID: peerID, Reason: reason})
+	}
+	events = append(events, PeerEvent{Type: PeerDisconnected, PeerID: peerID, Reason: reason})
+	impl.pmrChangePeer(impl.pr.chDelPeer, mPeer.peer, events...)
 
-	impl.pr.chDelPeer <- peerInfo.peer
+	if impl.pmrShouldReconnect(peerID, reason) {
+		impl.pmrScheduleReconnect(peerID, impl.pmr.reconnectPolicy.backoff(0))
+		return
+	}
+	if errors.Is(reason, ErrClosed) || errors.Is(reason, ErrPeerReplaced) {
+		return
+	}
+	// a discovered peer goes back to the idle ones
+	if _, ok := impl.pmr.discoveredIDs[peerID]; ok {
+		if _, ok = impl.pmr.reconnects[peerID]; !ok {
+			impl.pmr.peerIdleIDs[peerID] = true
+			impl.pmrUpdateIdlePeerIDs()
+		}
+	}
+}
+
+// pmrCheckACL disconnects the peers the changed ACL denies.
+func (impl *peersProxyImpl) pmrCheckACL() {
+	for peerID, mPeer := range impl.pmr.peers {
+		if err := impl.acl.Check(peerID, mPeer.peer.GetInfo().RemoteAddrs); err != nil {
+			loge.Infof(impl.ctx, "disconnect peer %v: %v", peerID, err)
+			impl.pmrRemovePeer(peerID, err)
+		}
+	}
 }
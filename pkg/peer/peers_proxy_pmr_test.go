@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func listedPeers(node *testNode) []string {
+	ch := make(chan []string, 1)
+	node.ListPeers(func(peerIDs []string) {
+		ch <- peerIDs
+	})
+	return <-ch
+}
+
+// assertNoPeerEvent checks no event of type evType about peerID comes for a while.
+func assertNoPeerEvent(t *testing.T, chEvents <-chan PeerEvent, evType PeerEventType, peerID string) {
+	timeout := time.After(500 * time.Millisecond)
+	for {
+		select {
+		case ev := <-chEvents:
+			assert.False(t, ev.Type == evType && ev.PeerID == peerID, "unexpected %v of %v", evType, peerID)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestPeersProxyACLOutbound(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.Reconnect.BaseDelay = 50 * time.Millisecond
+	})
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	a.ACL().DenyPeer(c.GetID())
+	assert.ErrorIs(t, a.connect(c), ErrPeerDenied)
+	assert.NotContains(t, listedPeers(a), c.GetID())
+
+	// a connected sticky peer is dropped once it is denied and never redialed
+	connectTestNodes(t, a, b)
+	a.AddStickyPeer(b.GetID())
+	a.ACL().DenyPeer(b.GetID())
+	ev := waitPeerEvent(t, chEvents, PeerDisconnected, b.GetID())
+	assert.ErrorIs(t, ev.Reason, ErrPeerDenied)
+	assertNoPeerEvent(t, chEvents, PeerConnected, b.GetID())
+	assert.NotContains(t, listedPeers(a), b.GetID())
+}
+
+func TestPeersProxyACLInbound(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	a.ACL().DenyPeer(b.GetID())
+	// the stream of b is reset by a
+	_ = b.connect(a)
+	assertNoPeerEvent(t, chEvents, PeerConnected, b.GetID())
+	assert.NotContains(t, listedPeers(a), b.GetID())
+	assert.Eventually(t, func() bool {
+		return len(listedPeers(b)) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// allowed again it may connect
+	a.ACL().RemovePeer(b.GetID())
+	connectTestNodes(t, b, a)
+}
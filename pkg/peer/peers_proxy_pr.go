@@ -1,55 +1,102 @@
 package peer
 
 import (
+	"fmt"
+
 	"github.com/jiuzhou-zhao/go-fundamental/loge"
-	"github.com/jiuzhou-zhao/go-fundamental/structs/tools"
 )
 
 type prRequest struct {
 	peerID     string
 	msg        Message
 	executeCnt int
+	fnResult   DeliveryCallback
+	// topic limits a broadcast to the peers subscribing it
+	topic string
+	// fromPeerID is excluded from a broadcast, it is the peer a relayed message came from
+	fromPeerID string
+}
+
+func (req *prRequest) done(peerID string, err error) {
+	if req.fnResult != nil {
+		req.fnResult(peerID, err)
+	}
+}
+
+func (impl *peersProxyImpl) prSendToPeer(peer PeerProxy, req *prRequest) {
+	impl.prSendMessageToPeer(peer, req.msg, req.fnResult)
+}
+
+func (impl *peersProxyImpl) prSendMessageToPeer(peer PeerProxy, msg Message, fnResult DeliveryCallback) {
+	if fnResult == nil {
+		peer.DoRequest(msg)
+		return
+	}
+	peerID := peer.GetPeerID()
+	peer.Send(msg, func(err error) {
+		fnResult(peerID, err)
+	})
 }
 
 type PR struct {
 	peers       map[string]PeerProxy
 	idlePeerIDs []string
+	peerTopics  map[string]map[string]interface{}
 
-	chAddPeer       chan PeerProxy
-	chDelPeer       chan PeerProxy
+	chAddPeer       chan *prPeerChange
+	chDelPeer       chan *prPeerChange
 	chUpdateIdleIDs chan []string
 	chDoRequest     chan *prRequest
 	chDoAny         chan func()
 
-	ec tools.ExistsChecker
+	seenCache *seenCache
+	history   *gossipHistory
 }
 
-func newPR() *PR {
+func newPR(cfg *P2PConfig) *PR {
 	return &PR{
 		peers:           make(map[string]PeerProxy),
-		chAddPeer:       make(chan PeerProxy, 2),
-		chDelPeer:       make(chan PeerProxy, 2),
+		peerTopics:      make(map[string]map[string]interface{}),
+		chAddPeer:       make(chan *prPeerChange, 2),
+		chDelPeer:       make(chan *prPeerChange, 2),
 		chUpdateIdleIDs: make(chan []string),
 		chDoRequest:     make(chan *prRequest, 2),
 		chDoAny:         make(chan func(), 2),
-		ec:              tools.NewExistsCheckerWithMaxSize(99999999),
+		seenCache:       newSeenCache(cfg.SeenCacheSize, cfg.SeenCacheTTL),
+		history:         newGossipHistory(cfg.GossipHistorySize, cfg.GossipHistoryTTL),
 	}
 }
 
+// prPeerChange adds or removes a peer, its events are published once pr has applied it so that
+// ListPeers agrees with them.
+type prPeerChange struct {
+	peer   PeerProxy
+	events []PeerEvent
+}
+
+// seen records msgID and reports whether it was recorded before.
+func (pr *PR) seen(msgID string) bool {
+	return pr.seenCache.seen(msgID)
+}
+
 func (impl *peersProxyImpl) peersRoutine() {
+	defer impl.wg.Done()
+
 	loge.Info(impl.ctx, "peer routine enter")
 	loop := true
 	for loop {
 		select {
 		case <-impl.ctx.Done():
 			loop = false
-		case peer := <-impl.pr.chAddPeer:
+		case change := <-impl.pr.chAddPeer:
 			loge.Debug(nil, "peersRoutine add peer begin")
-			impl.prAddPeer(peer)
+			impl.prAddPeer(change.peer)
+			impl.publishEvents(change.events)
 			loge.Debug(nil, "peersRoutine add peer end")
-		case peer := <-impl.pr.chDelPeer:
+		case change := <-impl.pr.chDelPeer:
 			loge.Debug(nil, "peersRoutine del peer begin")
-			impl.prDelPeer(peer)
+			impl.prDelPeer(change.peer)
+			impl.publishEvents(change.events)
 			loge.Debug(nil, "peersRoutine del peer end")
 		case req := <-impl.pr.chDoRequest:
 			loge.Debug(nil, "peersRoutine do request begin")
@@ -65,36 +112,82 @@ func (impl *peersProxyImpl) peersRoutine() {
 			loge.Debug(nil, "peersRoutine update idle peer ids end")
 		}
 	}
+	impl.prDrainRequests()
 	loge.Info(impl.ctx, "peer routine leave")
 }
 
+func (impl *peersProxyImpl) prDrainRequests() {
+	for {
+		select {
+		case req := <-impl.pr.chDoRequest:
+			loge.Warnf(impl.ctx, "prDoRequest %v dropped: peers proxy closed", req.peerID)
+			req.done(req.peerID, ErrClosed)
+		case change := <-impl.pr.chAddPeer:
+			impl.publishEvents(change.events)
+		case change := <-impl.pr.chDelPeer:
+			impl.publishEvents(change.events)
+		default:
+			return
+		}
+	}
+}
+
 func (impl *peersProxyImpl) prUpdateIdlePeerIDs(ids []string) {
 	impl.pr.idlePeerIDs = ids
 }
 
 func (impl *peersProxyImpl) prDoRequest(req *prRequest) {
 	if req.peerID == "" {
-		for _, peer := range impl.pr.peers {
-			if req.msg.GossipFlag() {
-				impl.pr.ec.Add(req.msg.ID())
-			}
-			peer.DoRequest(req.msg)
+		peers := impl.prBroadcastPeers(req)
+		if len(peers) == 0 {
+			req.done("", ErrNoPeers)
+			return
+		}
+		if req.topic != "" || req.msg.GossipFlag() {
+			// a relayed message is counted by onGossip already
+			impl.pr.seenCache.add(req.msg.ID())
+			impl.prGossip(req, peers)
+			return
+		}
+		for _, peer := range peers {
+			impl.prSendToPeer(peer, req)
 		}
 		return
 	}
 	if peer, ok := impl.pr.peers[req.peerID]; ok {
-		peer.DoRequest(req.msg)
+		impl.prSendToPeer(peer, req)
 	} else {
 		loge.Warnf(impl.ctx, "prDoRequest %v failed: no peer", req.peerID)
 		req.executeCnt++
 		if req.executeCnt >= 10 {
 			loge.Errorf(impl.ctx, "prDoRequest failed for %v", req)
+			req.done(req.peerID, fmt.Errorf("%w: %v", ErrPeerUnreachable, req.peerID))
 			return
 		}
-		impl.pmr.chDoSlowRequest <- req
+		select {
+		case impl.pmr.chDoSlowRequest <- req:
+		case <-impl.ctx.Done():
+			req.done(req.peerID, ErrClosed)
+		}
 	}
 }
 
+func (impl *peersProxyImpl) prBroadcastPeers(req *prRequest) []PeerProxy {
+	peers := make([]PeerProxy, 0, len(impl.pr.peers))
+	for peerID, peer := range impl.pr.peers {
+		if peerID == req.fromPeerID {
+			continue
+		}
+		if req.topic != "" {
+			if _, ok := impl.pr.peerTopics[peerID][req.topic]; !ok {
+				continue
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
 func (impl *peersProxyImpl) prAddPeer(peer PeerProxy) {
 	if oPeer, ok := impl.pr.peers[peer.GetPeerID()]; ok {
 		if oPeer == peer {
@@ -103,8 +196,13 @@ func (impl *peersProxyImpl) prAddPeer(peer PeerProxy) {
 		impl.prDelPeer(peer)
 	}
 	impl.pr.peers[peer.GetPeerID()] = peer
+
+	if len(impl.subscribedTopics()) > 0 {
+		impl.prAnnounceSubscriptions([]PeerProxy{peer})
+	}
 }
 
 func (impl *peersProxyImpl) prDelPeer(peer PeerProxy) {
 	delete(impl.pr.peers, peer.GetPeerID())
+	delete(impl.pr.peerTopics, peer.GetPeerID())
 }
@@ -0,0 +1,74 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDelivery struct {
+	peerID string
+	err    error
+}
+
+func sendAndWait(t *testing.T, node *testNode, peerID string, msg Message, n int) []testDelivery {
+	chDelivery := make(chan testDelivery, n)
+	node.Send(peerID, msg, func(peerID string, err error) {
+		chDelivery <- testDelivery{peerID: peerID, err: err}
+	})
+
+	deliveries := make([]testDelivery, 0, n)
+	for len(deliveries) < n {
+		select {
+		case delivery := <-chDelivery:
+			deliveries = append(deliveries, delivery)
+		case <-time.After(10 * time.Second):
+			assert.Fail(t, "delivery not reported")
+			return deliveries
+		}
+	}
+	return deliveries
+}
+
+func TestPeersProxySend(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+	connectTestNodes(t, a, b)
+	connectTestNodes(t, a, c)
+
+	msg := a.newMessage(t, "direct")
+	assert.Equal(t, []testDelivery{{peerID: b.GetID()}}, sendAndWait(t, a, b.GetID(), msg, 1))
+	arrived := waitArrived(t, b)
+	assert.Equal(t, a.GetID(), arrived.peerID)
+	assert.Equal(t, msg.ID(), arrived.msg.ID())
+
+	// a broadcast reports every connected peer
+	msg = a.newMessage(t, "broadcast")
+	assert.ElementsMatch(t, []testDelivery{{peerID: b.GetID()}, {peerID: c.GetID()}},
+		sendAndWait(t, a, "", msg, 2))
+	assert.Equal(t, msg.ID(), waitArrived(t, b).msg.ID())
+	assert.Equal(t, msg.ID(), waitArrived(t, c).msg.ID())
+}
+
+func TestPeersProxySendNoPeers(t *testing.T) {
+	a := newTestNode(t, nil)
+
+	deliveries := sendAndWait(t, a, "", a.newMessage(t, "nobody"), 1)
+	assert.Equal(t, "", deliveries[0].peerID)
+	assert.ErrorIs(t, deliveries[0].err, ErrNoPeers)
+}
+
+func TestPeersProxySendUnknownPeer(t *testing.T) {
+	a := newTestNode(t, nil)
+	// a valid peer ID a has no address of
+	unknown := newTestNode(t, nil)
+
+	for _, peerID := range []string{unknown.GetID(), "not a peer id"} {
+		deliveries := sendAndWait(t, a, peerID, a.newMessage(t, "lost"), 1)
+		assert.Equal(t, peerID, deliveries[0].peerID)
+		assert.ErrorIs(t, deliveries[0].err, ErrPeerUnreachable)
+	}
+	assert.Empty(t, a.connectedPeers())
+}
@@ -0,0 +1,191 @@
+package peer
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+)
+
+const (
+	defaultReconnectBaseDelay   = time.Second
+	defaultReconnectMaxDelay    = 2 * time.Minute
+	defaultReconnectJitter      = 0.2
+	defaultReconnectMaxAttempts = 10
+	defaultReconnectCooldown    = 10 * time.Minute
+)
+
+// ReconnectPolicy schedules the reconnection of dropped peers, the delay before attempt n is
+// BaseDelay * 2^n capped to MaxDelay, randomized by +/- Jitter of it. After MaxAttempts failures
+// a sticky peer waits Cooldown and starts over, any other peer is left to discovery.
+type ReconnectPolicy struct {
+	// BaseDelay is 1 second if <= 0
+	BaseDelay time.Duration
+	// MaxDelay is 2 minutes if <= 0
+	MaxDelay time.Duration
+	// Jitter is a fraction of the delay, 0.2 if <= 0
+	Jitter float64
+	// MaxAttempts is 10 if <= 0
+	MaxAttempts int
+	// Cooldown is 10 minutes if <= 0
+	Cooldown time.Duration
+	// Disabled turns the reconnection of non sticky peers off
+	Disabled bool
+}
+
+func (policy ReconnectPolicy) withDefaults() ReconnectPolicy {
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = defaultReconnectBaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = defaultReconnectMaxDelay
+	}
+	if policy.Jitter <= 0 {
+		policy.Jitter = defaultReconnectJitter
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultReconnectMaxAttempts
+	}
+	if policy.Cooldown <= 0 {
+		policy.Cooldown = defaultReconnectCooldown
+	}
+	return policy
+}
+
+// backoff returns the delay before the attempt after failed ones.
+func (policy ReconnectPolicy) backoff(failed int) time.Duration {
+	delay := policy.MaxDelay
+	if failed < 32 && policy.BaseDelay<<uint(failed) < policy.MaxDelay {
+		delay = policy.BaseDelay << uint(failed)
+	}
+	jitter := float64(delay) * policy.Jitter * (2*rand.Float64() - 1)
+	return delay + time.Duration(jitter)
+}
+
+type pmrReconnect struct {
+	failed int
+	next   time.Time
+}
+
+// pmrShouldReconnect tells if a peer closed for reason is worth a reconnection, a peer closed
+// for a frame it should not have sent is not.
+func (impl *peersProxyImpl) pmrShouldReconnect(peerID string, reason error) bool {
+	if errors.Is(reason, ErrPeerDenied) || errors.Is(reason, ErrPeerBanned) || errors.Is(reason, ErrPeerScoreLow) ||
+		errors.Is(reason, ErrRateLimited) || errors.Is(reason, p2pio.ErrFrameTooLarge) {
+		return false
+	}
+	if _, ok := impl.pmr.stickyIDs[peerID]; ok {
+		return !errors.Is(reason, ErrClosed)
+	}
+	if impl.pmr.reconnectPolicy.Disabled {
+		return false
+	}
+	if errors.Is(reason, ErrClosed) || errors.Is(reason, ErrPeerReplaced) {
+		return false
+	}
+	_, ok := impl.pmr.discoveredIDs[peerID]
+	return ok
+}
+
+func (impl *peersProxyImpl) pmrScheduleReconnect(peerID string, delay time.Duration) {
+	state, ok := impl.pmr.reconnects[peerID]
+	if !ok {
+		state = &pmrReconnect{}
+		impl.pmr.reconnects[peerID] = state
+	}
+	state.next = time.Now().Add(delay)
+	impl.pmrResetReconnectTimer()
+}
+
+// pmrResetReconnectTimer arms the timer for the earliest scheduled reconnection.
+func (impl *peersProxyImpl) pmrResetReconnectTimer() {
+	timer := impl.pmr.reconnectTimer
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	var next time.Time
+	for _, state := range impl.pmr.reconnects {
+		if next.IsZero() || state.next.Before(next) {
+			next = state.next
+		}
+	}
+	if !next.IsZero() {
+		timer.Reset(time.Until(next))
+	}
+}
+
+func (impl *peersProxyImpl) pmrReconnectDue() {
+	now := time.Now()
+	for peerID, state := range impl.pmr.reconnects {
+		if state.next.After(now) {
+			continue
+		}
+		if _, ok := impl.pmr.peers[peerID]; ok {
+			delete(impl.pmr.reconnects, peerID)
+			continue
+		}
+		_, sticky := impl.pmr.stickyIDs[peerID]
+		if !sticky && impl.cfg.MaxConnectedPeers > 0 && impl.pmrRegularPeerCount() >= impl.cfg.MaxConnectedPeers {
+			state.next = now.Add(impl.pmr.reconnectPolicy.backoff(state.failed))
+			continue
+		}
+
+		_, err := impl.pmrConnect(peerID)
+		if err == nil {
+			loge.Infof(impl.ctx, "peer %v reconnected", peerID)
+			delete(impl.pmr.reconnects, peerID)
+			if _, ok := impl.pmr.peerIdleIDs[peerID]; ok {
+				delete(impl.pmr.peerIdleIDs, peerID)
+				impl.pmrUpdateIdlePeerIDs()
+			}
+			continue
+		}
+		loge.Warnf(impl.ctx, "reconnect peer %v failed: %v", peerID, err)
+
+		state.failed++
+		if state.failed < impl.pmr.reconnectPolicy.MaxAttempts {
+			state.next = now.Add(impl.pmr.reconnectPolicy.backoff(state.failed))
+			continue
+		}
+		if sticky {
+			state.failed = 0
+			state.next = now.Add(impl.pmr.reconnectPolicy.Cooldown)
+			continue
+		}
+		loge.Warnf(impl.ctx, "give up reconnecting peer %v", peerID)
+		delete(impl.pmr.reconnects, peerID)
+		if _, ok := impl.pmr.discoveredIDs[peerID]; ok {
+			impl.pmr.peerIdleIDs[peerID] = true
+			impl.pmrUpdateIdlePeerIDs()
+		}
+	}
+	impl.pmrResetReconnectTimer()
+}
+
+// AddStickyPeer keeps peerID connected until RemoveStickyPeer, whatever MaxConnectedPeers is.
+func (impl *peersProxyImpl) AddStickyPeer(peerID string) {
+	if peerID == "" {
+		return
+	}
+	impl.pmrDoAny(func() {
+		impl.pmr.stickyIDs[peerID] = true
+		if _, ok := impl.pmr.peers[peerID]; !ok {
+			impl.pmrScheduleReconnect(peerID, 0)
+		}
+	})
+}
+
+func (impl *peersProxyImpl) RemoveStickyPeer(peerID string) {
+	impl.pmrDoAny(func() {
+		delete(impl.pmr.stickyIDs, peerID)
+		if _, ok := impl.pmr.discoveredIDs[peerID]; !ok {
+			delete(impl.pmr.reconnects, peerID)
+		}
+	})
+}
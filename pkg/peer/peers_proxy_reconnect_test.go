@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+	"github.com/sgostarter/libp2p/pkg/talk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	policy := ReconnectPolicy{
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+	}.withDefaults()
+
+	for failed, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		delay := policy.backoff(failed)
+		assert.InDelta(t, float64(want), float64(delay), float64(want)*policy.Jitter)
+	}
+	for _, failed := range []int{6, 7, 40, 100} {
+		delay := policy.backoff(failed)
+		assert.InDelta(t, float64(time.Minute), float64(delay), float64(time.Minute)*policy.Jitter)
+	}
+}
+
+// dropPeer closes the session of node with peerID as if the stream broke.
+func dropPeer(node *testNode, peerID string) {
+	node.pmrDoAny(func() {
+		node.pmrRemovePeer(peerID, ErrPeerClosed)
+	})
+}
+
+func TestPeersProxyStaticPeers(t *testing.T) {
+	b := newTestNode(t, nil)
+	// a has nothing but its static peer to connect to
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.DisableDHT = true
+		cfg.StaticPeers = []string{b.addr()}
+		cfg.Reconnect.BaseDelay = 100 * time.Millisecond
+	})
+	waitConnected(t, a, b.GetID())
+	waitConnected(t, b, a.GetID())
+
+	// a static peer is sticky, it is redialed when it drops
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+	dropPeer(b, a.GetID())
+	waitPeerEvent(t, chEvents, PeerDisconnected, b.GetID())
+	waitPeerEvent(t, chEvents, PeerConnected, b.GetID())
+	waitConnected(t, b, a.GetID())
+}
+
+func TestPeersProxyStickyPeer(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.Reconnect.BaseDelay = 100 * time.Millisecond
+	})
+	b := newTestNode(t, nil)
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	_, err := talk.AddPeerAddr(a.host, b.addr())
+	assert.Nil(t, err)
+	a.AddStickyPeer(b.GetID())
+	waitPeerEvent(t, chEvents, PeerConnected, b.GetID())
+	waitConnected(t, b, a.GetID())
+
+	dropPeer(b, a.GetID())
+	waitPeerEvent(t, chEvents, PeerDisconnected, b.GetID())
+	waitPeerEvent(t, chEvents, PeerConnected, b.GetID())
+	waitConnected(t, b, a.GetID())
+
+	// b is neither sticky nor discovered any more, it is not redialed
+	a.RemoveStickyPeer(b.GetID())
+	dropPeer(b, a.GetID())
+	waitPeerEvent(t, chEvents, PeerDisconnected, b.GetID())
+	time.Sleep(500 * time.Millisecond)
+	assert.NotContains(t, a.connectedPeers(), b.GetID())
+}
+
+func TestPeersProxyStickyPeerFrameTooLarge(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.Reconnect.BaseDelay = 100 * time.Millisecond
+	})
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	h, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	assert.Nil(t, err)
+	defer func() {
+		_ = h.Close()
+	}()
+	var streams int32
+	h.SetStreamHandler("peers.proxy.test", func(stream network.Stream) {
+		atomic.AddInt32(&streams, 1)
+		var header [binary.MaxVarintLen64]byte
+		_, _ = stream.Write(header[:binary.PutUvarint(header[:], 1<<30)])
+		_, _ = io.Copy(ioutil.Discard, stream)
+	})
+	hID := h.ID().Pretty()
+	_, err = talk.AddPeerAddr(a.host, h.Addrs()[0].String()+"/p2p/"+hID)
+	assert.Nil(t, err)
+
+	// a sticky peer is not redialed once it sent a frame it should not have
+	a.AddStickyPeer(hID)
+	ev := waitPeerEvent(t, chEvents, PeerDisconnected, hID)
+	assert.ErrorIs(t, ev.Reason, p2pio.ErrFrameTooLarge)
+	time.Sleep(500 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&streams))
+}
@@ -0,0 +1,262 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/sgostarter/libp2p/pkg/talk"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func init() {
+	loge.SetGlobalLogger(loge.NewLogger(&loge.EmptyLogger{}))
+}
+
+type testMessage struct {
+	id string
+}
+
+func (msg *testMessage) Bytes() []byte {
+	return []byte(msg.id)
+}
+
+func (msg *testMessage) ID() string {
+	return msg.id
+}
+
+func (msg *testMessage) GossipFlag() bool {
+	return false
+}
+
+type testMessageHelper struct {
+}
+
+func (mh *testMessageHelper) ReadMessage(reader io.Reader) (Message, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (mh *testMessageHelper) CreatePingMessage(peerID string) (Message, error) {
+	return &testMessage{id: "ping"}, nil
+}
+
+func (mh *testMessageHelper) CreatePongMessage(pingMessage Message) (Message, error) {
+	return &testMessage{id: "pong"}, nil
+}
+
+func (mh *testMessageHelper) IsPingMessage(message Message) bool {
+	return message.ID() == "ping"
+}
+
+func (mh *testMessageHelper) IsPongMessage(message Message) bool {
+	return message.ID() == "pong"
+}
+
+type testMessageArrivedObserver struct {
+}
+
+func (ob *testMessageArrivedObserver) OnDataArrived(peerID string, msg Message) {
+}
+
+func newTestPeersProxy(t *testing.T) PeersProxy {
+	peersProxy := NewPeersProxy(context.Background(), &Config{
+		P2PConfig: P2PConfig{
+			AdvertiseNameSpace: "peers_proxy_test",
+			BootstrapPeers:     []string{},
+			ProtocolID:         "peers.proxy.test",
+		},
+		MessageConfig: MessageConfig{
+			MessageArrivedOb: &testMessageArrivedObserver{},
+			MessageHelper:    &testMessageHelper{},
+		},
+	})
+	assert.NotNil(t, peersProxy)
+	peersProxy.Wait4Ready()
+	return peersProxy
+}
+
+func TestPeersProxyClose(t *testing.T) {
+	peersProxy := newTestPeersProxy(t)
+	assert.NotEqual(t, "", peersProxy.GetID())
+	chEvents, _ := peersProxy.SubscribePeerEvents(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(t, peersProxy.Close(ctx))
+
+	evt, ok := <-chEvents
+	assert.True(t, ok)
+	assert.Equal(t, ReadyStateChanged, evt.Type)
+	assert.False(t, evt.Ready)
+	_, ok = <-chEvents
+	assert.False(t, ok)
+
+	// requests after close must not block
+	peersProxy.DoRequest("", &testMessage{id: "after close"})
+	assert.Nil(t, peersProxy.Close(ctx))
+}
+
+type testArrived struct {
+	peerID string
+	msg    *ProtoMessage
+}
+
+// testObserver records the messages delivered to the application, onData may answer them.
+type testObserver struct {
+	chArrived chan testArrived
+	onData    func(peerID string, msg *ProtoMessage)
+}
+
+func (ob *testObserver) OnDataArrived(peerID string, msg Message) {
+	pMsg := msg.(*ProtoMessage)
+	if ob.onData != nil {
+		ob.onData(peerID, pMsg)
+	}
+	select {
+	case ob.chArrived <- testArrived{peerID: peerID, msg: pMsg}:
+	default:
+	}
+}
+
+// testNode is a PeersProxy listening on a random port without the DHT, the tests connect the
+// nodes to each other.
+type testNode struct {
+	*peersProxyImpl
+	helper *ProtoMessageHelper
+	ob     *testObserver
+}
+
+func newTestNode(t *testing.T, fnConfig func(cfg *Config)) *testNode {
+	node := &testNode{
+		helper: NewProtoMessageHelper(0),
+		ob: &testObserver{
+			chArrived: make(chan testArrived, 100),
+		},
+	}
+	cfg := &Config{
+		P2PConfig: P2PConfig{
+			ProtocolID: "peers.proxy.test",
+			DisableDHT: true,
+		},
+		MessageConfig: MessageConfig{
+			MessageArrivedOb: node.ob,
+			MessageHelper:    node.helper,
+		},
+	}
+	if fnConfig != nil {
+		fnConfig(cfg)
+	}
+	peersProxy := NewPeersProxy(context.Background(), cfg)
+	assert.NotNil(t, peersProxy)
+	peersProxy.Wait4Ready()
+	node.peersProxyImpl = peersProxy.(*peersProxyImpl)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = node.Close(ctx)
+	})
+	return node
+}
+
+// addr returns the loopback multiaddr of the node.
+func (node *testNode) addr() string {
+	for _, addr := range node.host.(host.Host).Addrs() {
+		if strings.HasPrefix(addr.String(), "/ip4/127.0.0.1/") {
+			return addr.String() + "/p2p/" + node.GetID()
+		}
+	}
+	return ""
+}
+
+// connect dials other from node, the error is the one of the dial.
+func (node *testNode) connect(other *testNode) error {
+	return node.dial(other.addr())
+}
+
+// dial connects node to the full multiaddr addr.
+func (node *testNode) dial(addr string) error {
+	peerID, err := talk.AddPeerAddr(node.host, addr)
+	if err != nil {
+		return err
+	}
+	chErr := make(chan error, 1)
+	node.pmrDoAny(func() {
+		_, err := node.pmrConnect(peerID)
+		chErr <- err
+	})
+	return <-chErr
+}
+
+func (node *testNode) connectedPeers() []string {
+	ch := make(chan []string, 1)
+	node.ListPeers(func(peerIDs []string) {
+		ch <- peerIDs
+	}, WithState(PeerStateConnected))
+	return <-ch
+}
+
+func (node *testNode) newMessage(t *testing.T, s string) *ProtoMessage {
+	msg, err := node.helper.NewMessage(wrapperspb.String(s))
+	assert.Nil(t, err)
+	return msg
+}
+
+// connectTestNodes connects a to b and waits until both list each other.
+func connectTestNodes(t *testing.T, a, b *testNode) {
+	assert.Nil(t, a.connect(b))
+	waitConnected(t, a, b.GetID())
+	waitConnected(t, b, a.GetID())
+}
+
+// newSilentHost starts a host which accepts the streams of the test protocol but never reads
+// nor writes them, it returns its peer ID and the multiaddr to dial it.
+func newSilentHost(t *testing.T) (string, string) {
+	h, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	assert.Nil(t, err)
+	chClosed := make(chan struct{})
+	h.SetStreamHandler("peers.proxy.test", func(stream network.Stream) {
+		<-chClosed
+		_ = stream.Reset()
+	})
+	t.Cleanup(func() {
+		close(chClosed)
+		_ = h.Close()
+	})
+	return h.ID().Pretty(), h.Addrs()[0].String() + "/p2p/" + h.ID().Pretty()
+}
+
+func waitConnected(t *testing.T, node *testNode, peerID string) {
+	assert.Eventually(t, func() bool {
+		for _, id := range node.connectedPeers() {
+			if id == peerID {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func waitArrived(t *testing.T, node *testNode) testArrived {
+	select {
+	case arrived := <-node.ob.chArrived:
+		return arrived
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "no message arrived")
+		return testArrived{}
+	}
+}
+
+func payloadString(msg *ProtoMessage) string {
+	if s, ok := msg.Payload().(*wrapperspb.StringValue); ok {
+		return s.GetValue()
+	}
+	return ""
+}
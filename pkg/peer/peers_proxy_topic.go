@@ -0,0 +1,144 @@
+package peer
+
+import (
+	"sort"
+
+	"github.com/jiuzhou-zhao/go-fundamental/loge"
+)
+
+// TopicHandler receives the messages published to the topic it subscribes.
+type TopicHandler func(peerID string, msg Message)
+
+func (impl *peersProxyImpl) Subscribe(topic string, handler TopicHandler) error {
+	if topic == "" || handler == nil {
+		return ErrInvalidTopic
+	}
+	if _, ok := impl.messageHelper.(ControlMessageHelper); !ok {
+		return ErrNotSupported
+	}
+	if _, ok := impl.messageHelper.(MetaMessageHelper); !ok {
+		return ErrNotSupported
+	}
+
+	impl.topicLock.Lock()
+	if _, ok := impl.topics[topic]; ok {
+		impl.topicLock.Unlock()
+		return ErrAlreadySubscribed
+	}
+	impl.topics[topic] = handler
+	impl.topicLock.Unlock()
+
+	impl.doAny(func() {
+		impl.prAnnounceSubscriptions(impl.prAllPeers())
+	})
+	return nil
+}
+
+func (impl *peersProxyImpl) Unsubscribe(topic string) {
+	impl.topicLock.Lock()
+	_, ok := impl.topics[topic]
+	delete(impl.topics, topic)
+	impl.topicLock.Unlock()
+
+	if !ok {
+		return
+	}
+	impl.doAny(func() {
+		impl.prAnnounceSubscriptions(impl.prAllPeers())
+	})
+}
+
+func (impl *peersProxyImpl) Publish(topic string, msg Message) error {
+	if topic == "" {
+		return ErrInvalidTopic
+	}
+	metaHelper, ok := impl.messageHelper.(MetaMessageHelper)
+	if !ok {
+		return ErrNotSupported
+	}
+	topicMsg, err := metaHelper.SetMessageMeta(msg, MessageMeta{Topic: topic})
+	if err != nil {
+		return err
+	}
+	select {
+	case impl.pr.chDoRequest <- &prRequest{
+		msg:   topicMsg,
+		topic: topic,
+	}:
+	case <-impl.ctx.Done():
+		return ErrClosed
+	}
+	return nil
+}
+
+func (impl *peersProxyImpl) subscribedTopics() []string {
+	impl.topicLock.RLock()
+	defer impl.topicLock.RUnlock()
+
+	topics := make([]string, 0, len(impl.topics))
+	for topic := range impl.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (impl *peersProxyImpl) onControl(peerID string, ctrl *Control) {
+	switch ctrl.Kind {
+	case ControlIHave:
+		impl.onIHave(peerID, ctrl.IDs)
+	case ControlIWant:
+		impl.onIWant(peerID, ctrl.IDs)
+	case ControlSubscriptions:
+		topics := make(map[string]interface{}, len(ctrl.Topics))
+		for _, topic := range ctrl.Topics {
+			topics[topic] = true
+		}
+		impl.doAny(func() {
+			if _, ok := impl.pr.peers[peerID]; ok {
+				impl.pr.peerTopics[peerID] = topics
+			}
+		})
+	default:
+		loge.Warnf(impl.ctx, "peer %v sent unknown control %v", peerID, ctrl.Kind)
+	}
+}
+
+func (impl *peersProxyImpl) onTopicMessage(peerID, topic string, msg Message) {
+	if !impl.onGossip(peerID, topic, msg) {
+		return
+	}
+
+	impl.topicLock.RLock()
+	handler, ok := impl.topics[topic]
+	impl.topicLock.RUnlock()
+	if ok {
+		handler(peerID, msg)
+	}
+}
+
+func (impl *peersProxyImpl) prAllPeers() []PeerProxy {
+	peers := make([]PeerProxy, 0, len(impl.pr.peers))
+	for _, peer := range impl.pr.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (impl *peersProxyImpl) prAnnounceSubscriptions(peers []PeerProxy) {
+	ctrlHelper, ok := impl.messageHelper.(ControlMessageHelper)
+	if !ok || len(peers) == 0 {
+		return
+	}
+	msg, err := ctrlHelper.CreateControlMessage(&Control{
+		Kind:   ControlSubscriptions,
+		Topics: impl.subscribedTopics(),
+	})
+	if err != nil {
+		loge.Errorf(impl.ctx, "create subscriptions message failed: %v", err)
+		return
+	}
+	for _, peer := range peers {
+		peer.DoRequest(msg)
+	}
+}
@@ -0,0 +1,90 @@
+package peer
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// peerTopics returns the topics node knows peerID subscribes to.
+func peerTopics(node *testNode, peerID string) []string {
+	ch := make(chan []string, 1)
+	node.doAny(func() {
+		topics := make([]string, 0, len(node.pr.peerTopics[peerID]))
+		for topic := range node.pr.peerTopics[peerID] {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		ch <- topics
+	})
+	return <-ch
+}
+
+func waitPeerTopics(t *testing.T, node *testNode, peerID string, topics []string) {
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(topics, peerTopics(node, peerID))
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func subscribeTestTopic(t *testing.T, node *testNode, topic string) chan Message {
+	ch := make(chan Message, 10)
+	assert.Nil(t, node.Subscribe(topic, func(peerID string, msg Message) {
+		ch <- msg
+	}))
+	return ch
+}
+
+func TestPeersProxySubscriptionExchange(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	subscribeTestTopic(t, a, "sport")
+	subscribeTestTopic(t, b, "news")
+
+	// the subscriptions made before are exchanged on connect
+	connectTestNodes(t, a, b)
+	waitPeerTopics(t, a, b.GetID(), []string{"news"})
+	waitPeerTopics(t, b, a.GetID(), []string{"sport"})
+
+	// and the later ones are announced to the connected peers
+	subscribeTestTopic(t, b, "weather")
+	waitPeerTopics(t, a, b.GetID(), []string{"news", "weather"})
+	b.Unsubscribe("news")
+	waitPeerTopics(t, a, b.GetID(), []string{"weather"})
+
+	assert.ErrorIs(t, b.Subscribe("weather", func(string, Message) {}), ErrAlreadySubscribed)
+	assert.ErrorIs(t, b.Subscribe("", func(string, Message) {}), ErrInvalidTopic)
+}
+
+func TestPeersProxyPublish(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	c := newTestNode(t, nil)
+	chNews := subscribeTestTopic(t, b, "news")
+	chSport := subscribeTestTopic(t, c, "sport")
+	connectTestNodes(t, a, b)
+	connectTestNodes(t, a, c)
+	waitPeerTopics(t, a, b.GetID(), []string{"news"})
+	waitPeerTopics(t, a, c.GetID(), []string{"sport"})
+
+	msg := a.newMessage(t, "headline")
+	assert.Nil(t, a.Publish("news", msg))
+	select {
+	case got := <-chNews:
+		assert.Equal(t, msg.ID(), got.ID())
+		assert.Equal(t, "news", b.helper.GetMessageMeta(got).Topic)
+		assert.Equal(t, "headline", payloadString(got.(*ProtoMessage)))
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "published message not delivered")
+	}
+
+	// c does not subscribe news, the message is not even sent to it
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, c.pr.seenCache.contains(msg.ID()))
+	assert.Empty(t, chSport)
+	assert.Empty(t, c.ob.chArrived)
+	assert.Empty(t, b.ob.chArrived)
+
+	assert.ErrorIs(t, a.Publish("", msg), ErrInvalidTopic)
+}
@@ -0,0 +1,49 @@
+package peer
+
+// Priority orders the outbound messages queued for a peer, the zero value is PriorityNormal.
+type Priority int
+
+const (
+	PriorityBulk Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+	// PriorityControl is reserved for ping, pong and Control messages, they jump the queue
+	// and have their own limit, see SendQueuePolicy.ControlSize
+	PriorityControl
+)
+
+const priorityLevels = 4
+
+// level is the index of the priority's send queue list, 0 is popped first.
+func (priority Priority) level() int {
+	switch {
+	case priority >= PriorityControl:
+		return 0
+	case priority <= PriorityBulk:
+		return priorityLevels - 1
+	default:
+		return int(PriorityControl - priority)
+	}
+}
+
+func (priority Priority) String() string {
+	switch priority {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityControl:
+		return "control"
+	default:
+		return "unknown"
+	}
+}
+
+// PriorityMessage is implemented by messages which are not sent with PriorityNormal,
+// a message can't claim PriorityControl, it is sent with PriorityHigh instead.
+type PriorityMessage interface {
+	Message
+	Priority() Priority
+}
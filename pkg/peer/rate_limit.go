@@ -0,0 +1,223 @@
+package peer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket, a zero rate is unlimited.
+type RateLimit struct {
+	MessagesPerSecond float64
+	// MessageBurst is MessagesPerSecond if <= 0
+	MessageBurst   int
+	BytesPerSecond float64
+	// ByteBurst is BytesPerSecond if <= 0
+	ByteBurst int
+}
+
+// RateLimitAction is what a peer does with an inbound message over the rate limit. The peer
+// is only penalized or disconnected for going over its own limit, a message which is only over
+// the global limit is dropped.
+type RateLimitAction int
+
+const (
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitDelay stops reading the peer's stream until the message is within the limit
+	RateLimitDelay
+	// RateLimitPenalize drops the message and penalizes the peer with MisbehaviorSpam, it is
+	// the same as RateLimitDrop unless ScorePolicy.Enabled
+	RateLimitPenalize
+	// RateLimitDisconnect closes the peer with ErrRateLimited
+	RateLimitDisconnect
+)
+
+func (action RateLimitAction) String() string {
+	switch action {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitPenalize:
+		return "penalize"
+	case RateLimitDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// RateLimitPolicy limits the inbound messages of every peer and of all of them together,
+// ping and pong are not limited.
+type RateLimitPolicy struct {
+	PerPeer RateLimit
+	Global  RateLimit
+	Action  RateLimitAction
+}
+
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil if rate <= 0, a nil tokenBucket allows everything.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := &tokenBucket{
+		rate:  rate,
+		burst: float64(burst),
+		now:   time.Now,
+	}
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	b.tokens = b.burst
+	b.last = b.now()
+	return b
+}
+
+// refill must be called with the lock held.
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes n tokens if the bucket holds them, n larger than the burst only needs a full bucket
+// and leaves it in debt.
+func (b *tokenBucket) take(n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refund gives back the tokens of a take whose message was not let through after all.
+func (b *tokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// reserve takes n tokens, going into debt if needed, and returns the time until the debt is paid.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		messages: newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst),
+		bytes:    newTokenBucket(limit.BytesPerSecond, limit.ByteBurst),
+	}
+}
+
+// rateLimitResult tells which limit an inbound message is over.
+type rateLimitResult int
+
+const (
+	rateLimitAllowed rateLimitResult = iota
+	rateLimitPeerExceeded
+	rateLimitGlobalExceeded
+)
+
+// inboundLimiter applies the limits of a peer and the global ones to its inbound messages.
+type inboundLimiter struct {
+	action  RateLimitAction
+	buckets []*tokenBucket
+}
+
+func newInboundLimiter(action RateLimitAction, peer, global *rateLimiter) *inboundLimiter {
+	return &inboundLimiter{
+		action:  action,
+		buckets: []*tokenBucket{peer.messages, peer.bytes, global.messages, global.bytes},
+	}
+}
+
+// amounts are the tokens a message of size bytes takes from each bucket, the ones of the peer
+// come first.
+func (l *inboundLimiter) amounts(size int) []float64 {
+	return []float64{1, float64(size), 1, float64(size)}
+}
+
+// allow takes the tokens of a message of size bytes from every bucket, or from none, and tells
+// which limit the message is over. The limits of the peer are checked first.
+func (l *inboundLimiter) allow(size int) rateLimitResult {
+	amounts := l.amounts(size)
+	for idx, b := range l.buckets {
+		if !b.take(amounts[idx]) {
+			for refundIdx := idx; refundIdx > 0; refundIdx-- {
+				l.buckets[refundIdx-1].refund(amounts[refundIdx-1])
+			}
+			if idx < 2 {
+				return rateLimitPeerExceeded
+			}
+			return rateLimitGlobalExceeded
+		}
+	}
+	return rateLimitAllowed
+}
+
+// wait takes the tokens of a message of size bytes and returns how long to wait before it is
+// within the limits.
+func (l *inboundLimiter) wait(size int) time.Duration {
+	amounts := l.amounts(size)
+	var wait time.Duration
+	for idx, b := range l.buckets {
+		if d := b.reserve(amounts[idx]); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func rateLimitedError(peerID string, size int) error {
+	return fmt.Errorf("%w: %v message of %v bytes", ErrRateLimited, peerID, size)
+}
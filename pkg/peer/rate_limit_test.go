@@ -0,0 +1,96 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 5)
+	b.now = func() time.Time {
+		return now
+	}
+	b.last = now
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.take(1))
+	}
+	assert.False(t, b.take(1))
+
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, b.take(1))
+	assert.False(t, b.take(1))
+
+	// a take larger than the burst needs a full bucket
+	now = now.Add(time.Second)
+	assert.True(t, b.take(8))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(2))
+
+	var unlimited *tokenBucket
+	assert.True(t, unlimited.take(1000))
+	assert.Zero(t, unlimited.reserve(1000))
+}
+
+func TestInboundLimiter(t *testing.T) {
+	global := newRateLimiter(RateLimit{MessagesPerSecond: 0.001, MessageBurst: 2})
+	peerA := newRateLimiter(RateLimit{BytesPerSecond: 0.001, ByteBurst: 100})
+	limiterA := newInboundLimiter(RateLimitDrop, peerA, global)
+	limiterB := newInboundLimiter(RateLimitDrop, newRateLimiter(RateLimit{}), global)
+
+	assert.Equal(t, rateLimitAllowed, limiterA.allow(60))
+	assert.Equal(t, rateLimitPeerExceeded, limiterA.allow(60))
+	assert.Equal(t, rateLimitAllowed, limiterB.allow(60))
+	// the global limit is reached, the tokens taken from peerA are given back
+	assert.Equal(t, rateLimitGlobalExceeded, limiterA.allow(30))
+	assert.InDelta(t, 40, peerA.bytes.tokens, 0.01)
+	assert.Equal(t, rateLimitGlobalExceeded, limiterB.allow(30))
+}
+
+type testMisbehaviorObserver struct {
+	misbehaviors []Misbehavior
+}
+
+func (ob *testMisbehaviorObserver) PeerMisbehaved(peer PeerProxy, misbehavior Misbehavior) {
+	ob.misbehaviors = append(ob.misbehaviors, misbehavior)
+}
+
+func TestPeerRateLimitGlobal(t *testing.T) {
+	global := newRateLimiter(RateLimit{MessagesPerSecond: 0.001, MessageBurst: 1})
+	ob := &testMisbehaviorObserver{}
+	newPeer := func(action RateLimitAction) *peerProxyImpl {
+		return &peerProxyImpl{
+			peerID:        "peer",
+			misbehaviorOb: ob,
+			limiter: newInboundLimiter(action,
+				newRateLimiter(RateLimit{MessagesPerSecond: 0.001, MessageBurst: 1}), global),
+		}
+	}
+	msg := &testMessage{id: "msg"}
+
+	a := newPeer(RateLimitDisconnect)
+	deliver, err := a.rateLimit(msg)
+	assert.True(t, deliver)
+	assert.Nil(t, err)
+
+	// the global limit is used up by a, the message of a peer within its own limit is only dropped
+	for _, action := range []RateLimitAction{RateLimitPenalize, RateLimitDisconnect} {
+		deliver, err = newPeer(action).rateLimit(msg)
+		assert.False(t, deliver)
+		assert.Nil(t, err)
+	}
+	assert.Empty(t, ob.misbehaviors)
+
+	// a is over its own limit
+	deliver, err = a.rateLimit(msg)
+	assert.False(t, deliver)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	b := newPeer(RateLimitPenalize)
+	b.limiter.buckets[0].tokens = 0
+	deliver, err = b.rateLimit(msg)
+	assert.False(t, deliver)
+	assert.Nil(t, err)
+	assert.Equal(t, []Misbehavior{MisbehaviorSpam}, ob.misbehaviors)
+}
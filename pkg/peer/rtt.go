@@ -0,0 +1,96 @@
+package peer
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RTTStats is the round trip time of a peer measured by the keepalive ping/pong.
+type RTTStats struct {
+	// RTT is the smoothed round trip time, zero until the first pong
+	RTT time.Duration
+	// RTTJitter is the smoothed deviation of the samples from RTT
+	RTTJitter time.Duration
+	// RTTSamples counts the pongs which produced a sample
+	RTTSamples uint64
+	// MissedPongs counts the pings in a row which got no pong in time
+	MissedPongs int
+}
+
+func newKeepAliveNonce() uint64 {
+	// zero means no nonce
+	return rand.Uint64() | 1
+}
+
+// rttEstimator smooths the keepalive samples the way TCP does (RFC 6298), only the latest ping is
+// outstanding, a pong for an older one is too late to be a useful sample.
+type rttEstimator struct {
+	stats        RTTStats
+	pendingNonce uint64
+	pendingAt    time.Time
+}
+
+// onPing reports whether the previous ping is missed.
+func (e *rttEstimator) onPing(nonce uint64, at time.Time) bool {
+	missed := !e.pendingAt.IsZero()
+	if missed {
+		e.stats.MissedPongs++
+	}
+	e.pendingNonce = nonce
+	e.pendingAt = at
+	return missed
+}
+
+// onPongTimeout counts the outstanding ping as missed, it reports whether there was one.
+func (e *rttEstimator) onPongTimeout() bool {
+	if e.pendingAt.IsZero() {
+		return false
+	}
+	e.pendingAt = time.Time{}
+	e.stats.MissedPongs++
+	return true
+}
+
+// onPong reports whether the pong answered the outstanding ping, nonce 0 answers any ping.
+func (e *rttEstimator) onPong(nonce uint64, at time.Time) bool {
+	if e.pendingAt.IsZero() || (nonce != 0 && nonce != e.pendingNonce) {
+		return false
+	}
+	sample := at.Sub(e.pendingAt)
+	e.pendingAt = time.Time{}
+	e.stats.MissedPongs = 0
+	if sample < 0 {
+		sample = 0
+	}
+
+	if e.stats.RTTSamples == 0 {
+		e.stats.RTT = sample
+		e.stats.RTTJitter = sample / 2
+	} else {
+		delta := e.stats.RTT - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		e.stats.RTTJitter += (delta - e.stats.RTTJitter) / 4
+		e.stats.RTT += (sample - e.stats.RTT) / 8
+	}
+	e.stats.RTTSamples++
+	return true
+}
+
+const (
+	// rttWeightOffset is added to the RTT of the weight, so that the closest peers are not
+	// picked overwhelmingly more than the others
+	rttWeightOffset = 50 * time.Millisecond
+	// unknownRTT stands for the RTT of the peers without a sample yet
+	unknownRTT = 100 * time.Millisecond
+)
+
+// rttWeight is the weight of a peer in the random peer selections, it decreases with its RTT.
+func rttWeight(stats RTTStats) float64 {
+	rtt := stats.RTT
+	if stats.RTTSamples == 0 {
+		rtt = unknownRTT
+	}
+	return 1 / (rtt + rttWeightOffset).Seconds()
+}
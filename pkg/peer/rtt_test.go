@@ -0,0 +1,42 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+	now := time.Now()
+
+	e.onPing(1, now)
+	assert.False(t, e.onPong(2, now.Add(time.Millisecond)))
+	assert.True(t, e.onPong(1, now.Add(80*time.Millisecond)))
+	assert.Equal(t, 80*time.Millisecond, e.stats.RTT)
+	assert.Equal(t, 40*time.Millisecond, e.stats.RTTJitter)
+
+	e.onPing(3, now)
+	assert.True(t, e.onPong(0, now.Add(160*time.Millisecond)))
+	assert.Equal(t, 90*time.Millisecond, e.stats.RTT)
+	assert.Equal(t, 50*time.Millisecond, e.stats.RTTJitter)
+	assert.EqualValues(t, 2, e.stats.RTTSamples)
+
+	// a pong without an outstanding ping is no sample
+	assert.False(t, e.onPong(0, now))
+
+	e.onPing(4, now)
+	e.onPing(5, now)
+	e.onPing(6, now)
+	assert.Equal(t, 2, e.stats.MissedPongs)
+	assert.False(t, e.onPong(5, now.Add(time.Second)))
+	assert.True(t, e.onPong(6, now.Add(time.Second)))
+	assert.Equal(t, 0, e.stats.MissedPongs)
+
+	e.onPing(7, now)
+	e.onPongTimeout()
+	e.onPongTimeout()
+	assert.Equal(t, 1, e.stats.MissedPongs)
+	assert.False(t, e.onPong(7, now.Add(time.Second)))
+}
@@ -0,0 +1,247 @@
+package peer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDecodeFailurePenalty = 20
+	defaultInvalidGossipPenalty = 10
+	defaultMissedPongPenalty    = 5
+	defaultSpamPenalty          = 1
+	defaultSpamRate             = 500
+	defaultSpamWindow           = time.Second
+	defaultScoreHalfLife        = 10 * time.Minute
+	defaultDisconnectThreshold  = -50
+	defaultBanThreshold         = -100
+	defaultBanDuration          = time.Hour
+)
+
+// Misbehavior is a peer fault which lowers its score.
+type Misbehavior int
+
+const (
+	// MisbehaviorDecodeFailure is a message the MessageHelper can't read
+	MisbehaviorDecodeFailure Misbehavior = iota + 1
+	// MisbehaviorSpam is a message over ScorePolicy.SpamRate
+	MisbehaviorSpam
+	// MisbehaviorInvalidGossip is a gossiped message or control a well behaved peer doesn't send
+	MisbehaviorInvalidGossip
+	// MisbehaviorMissedPong is a ping left without pong
+	MisbehaviorMissedPong
+)
+
+func (misbehavior Misbehavior) String() string {
+	switch misbehavior {
+	case MisbehaviorDecodeFailure:
+		return "decode failure"
+	case MisbehaviorSpam:
+		return "spam"
+	case MisbehaviorInvalidGossip:
+		return "invalid gossip"
+	case MisbehaviorMissedPong:
+		return "missed pong"
+	default:
+		return "unknown"
+	}
+}
+
+// ScorePolicy rates the peers, every peer starts at 0 and each misbehavior subtracts its penalty,
+// the score then recovers towards 0 with ScoreHalfLife. A peer is disconnected once its score
+// is <= DisconnectThreshold and banned for BanDuration once it is <= BanThreshold. Scores and
+// bans are kept as long as the PeersProxy lives, a peer disconnected for its score comes back
+// with it.
+type ScorePolicy struct {
+	// Enabled turns scoring on, it is off by default
+	Enabled bool
+
+	// penalties, the defaults are 20, 5, 10 and 1
+	DecodeFailurePenalty float64
+	MissedPongPenalty    float64
+	InvalidGossipPenalty float64
+	SpamPenalty          float64
+	// SpamRate is the count of messages a peer may send per SpamWindow, 500 per second by default
+	SpamRate   int
+	SpamWindow time.Duration
+
+	// ScoreHalfLife is 10 minutes if <= 0
+	ScoreHalfLife time.Duration
+	// DisconnectThreshold and BanThreshold are -50 and -100 if >= 0
+	DisconnectThreshold float64
+	BanThreshold        float64
+	// BanDuration is 1 hour if <= 0
+	BanDuration time.Duration
+}
+
+func (policy ScorePolicy) withDefaults() ScorePolicy {
+	for _, v := range []struct {
+		p   *float64
+		def float64
+	}{
+		{&policy.DecodeFailurePenalty, defaultDecodeFailurePenalty},
+		{&policy.MissedPongPenalty, defaultMissedPongPenalty},
+		{&policy.InvalidGossipPenalty, defaultInvalidGossipPenalty},
+		{&policy.SpamPenalty, defaultSpamPenalty},
+	} {
+		if *v.p <= 0 {
+			*v.p = v.def
+		}
+	}
+	if policy.SpamRate <= 0 {
+		policy.SpamRate = defaultSpamRate
+	}
+	if policy.SpamWindow <= 0 {
+		policy.SpamWindow = defaultSpamWindow
+	}
+	if policy.ScoreHalfLife <= 0 {
+		policy.ScoreHalfLife = defaultScoreHalfLife
+	}
+	if policy.DisconnectThreshold >= 0 {
+		policy.DisconnectThreshold = defaultDisconnectThreshold
+	}
+	if policy.BanThreshold >= 0 {
+		policy.BanThreshold = defaultBanThreshold
+	}
+	if policy.BanDuration <= 0 {
+		policy.BanDuration = defaultBanDuration
+	}
+	return policy
+}
+
+func (policy ScorePolicy) penalty(misbehavior Misbehavior) float64 {
+	switch misbehavior {
+	case MisbehaviorDecodeFailure:
+		return policy.DecodeFailurePenalty
+	case MisbehaviorSpam:
+		return policy.SpamPenalty
+	case MisbehaviorInvalidGossip:
+		return policy.InvalidGossipPenalty
+	case MisbehaviorMissedPong:
+		return policy.MissedPongPenalty
+	default:
+		return 0
+	}
+}
+
+type peerScore struct {
+	score       float64
+	updated     time.Time
+	bannedUntil time.Time
+	windowStart time.Time
+	windowCnt   int
+}
+
+// scoreBoard holds the scores of every peer seen, it is shared by the peer routines.
+type scoreBoard struct {
+	policy ScorePolicy
+	now    func() time.Time
+
+	lock   sync.Mutex
+	scores map[string]*peerScore
+}
+
+func newScoreBoard(policy ScorePolicy) *scoreBoard {
+	return &scoreBoard{
+		policy: policy.withDefaults(),
+		now:    time.Now,
+		scores: make(map[string]*peerScore),
+	}
+}
+
+// get returns the decayed score of peerID, it must be called with the lock held.
+func (sb *scoreBoard) get(peerID string, now time.Time) *peerScore {
+	ps, ok := sb.scores[peerID]
+	if !ok {
+		ps = &peerScore{updated: now}
+		sb.scores[peerID] = ps
+		return ps
+	}
+	if elapsed := now.Sub(ps.updated); elapsed > 0 {
+		ps.score *= math.Pow(0.5, float64(elapsed)/float64(sb.policy.ScoreHalfLife))
+		ps.updated = now
+	}
+	return ps
+}
+
+// penalize lowers the score of peerID, the error is why the peer must be disconnected,
+// it wraps ErrPeerBanned or ErrPeerScoreLow.
+func (sb *scoreBoard) penalize(peerID string, misbehavior Misbehavior, cnt int) error {
+	if !sb.policy.Enabled || cnt <= 0 {
+		return nil
+	}
+
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	now := sb.now()
+	ps := sb.get(peerID, now)
+	ps.score -= sb.policy.penalty(misbehavior) * float64(cnt)
+	switch {
+	case ps.score <= sb.policy.BanThreshold:
+		score := ps.score
+		ps.score = 0
+		ps.bannedUntil = now.Add(sb.policy.BanDuration)
+		return fmt.Errorf("%w: score %.1f after %v", ErrPeerBanned, score, misbehavior)
+	case ps.score <= sb.policy.DisconnectThreshold:
+		return fmt.Errorf("%w: score %.1f after %v", ErrPeerScoreLow, ps.score, misbehavior)
+	default:
+		return nil
+	}
+}
+
+// onMessage counts a message from peerID and penalizes it as spam if it is over SpamRate.
+func (sb *scoreBoard) onMessage(peerID string) error {
+	if !sb.policy.Enabled {
+		return nil
+	}
+
+	sb.lock.Lock()
+	now := sb.now()
+	ps := sb.get(peerID, now)
+	if now.Sub(ps.windowStart) >= sb.policy.SpamWindow {
+		ps.windowStart = now
+		ps.windowCnt = 0
+	}
+	ps.windowCnt++
+	spam := ps.windowCnt > sb.policy.SpamRate
+	sb.lock.Unlock()
+
+	if !spam {
+		return nil
+	}
+	return sb.penalize(peerID, MisbehaviorSpam, 1)
+}
+
+// checkBan returns an error wrapping ErrPeerBanned while peerID is banned.
+func (sb *scoreBoard) checkBan(peerID string) error {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	ps, ok := sb.scores[peerID]
+	if !ok || ps.bannedUntil.IsZero() {
+		return nil
+	}
+	if until := ps.bannedUntil; sb.now().Before(until) {
+		return fmt.Errorf("%w: %v until %v", ErrPeerBanned, peerID, until.Format(time.RFC3339))
+	}
+	ps.bannedUntil = time.Time{}
+	return nil
+}
+
+func (sb *scoreBoard) score(peerID string) (float64, time.Time) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	if _, ok := sb.scores[peerID]; !ok {
+		return 0, time.Time{}
+	}
+	now := sb.now()
+	ps := sb.get(peerID, now)
+	if now.After(ps.bannedUntil) {
+		return ps.score, time.Time{}
+	}
+	return ps.score, ps.bannedUntil
+}
@@ -0,0 +1,104 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/sgostarter/libp2p/pkg/p2pio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreBoard(t *testing.T) {
+	now := time.Now()
+	sb := newScoreBoard(ScorePolicy{Enabled: true, SpamRate: 2})
+	sb.now = func() time.Time {
+		return now
+	}
+
+	assert.Nil(t, sb.penalize("a", MisbehaviorDecodeFailure, 2))
+	score, _ := sb.score("a")
+	assert.InDelta(t, -40, score, 0.001)
+	assert.ErrorIs(t, sb.penalize("a", MisbehaviorInvalidGossip, 1), ErrPeerScoreLow)
+
+	// half of it is recovered after ScoreHalfLife
+	now = now.Add(sb.policy.ScoreHalfLife)
+	score, _ = sb.score("a")
+	assert.InDelta(t, -25, score, 0.001)
+
+	assert.ErrorIs(t, sb.penalize("a", MisbehaviorDecodeFailure, 4), ErrPeerBanned)
+	assert.ErrorIs(t, sb.checkBan("a"), ErrPeerBanned)
+	_, bannedUntil := sb.score("a")
+	assert.Equal(t, now.Add(sb.policy.BanDuration), bannedUntil)
+	now = now.Add(sb.policy.BanDuration)
+	assert.Nil(t, sb.checkBan("a"))
+
+	assert.Nil(t, sb.onMessage("b"))
+	assert.Nil(t, sb.onMessage("b"))
+	assert.Nil(t, sb.onMessage("b"))
+	score, _ = sb.score("b")
+	assert.InDelta(t, -1, score, 0.001)
+	now = now.Add(sb.policy.SpamWindow)
+	assert.Nil(t, sb.onMessage("b"))
+	score, _ = sb.score("b")
+	assert.InDelta(t, -1, score, 0.01)
+
+	score, bannedUntil = sb.score("c")
+	assert.Zero(t, score)
+	assert.True(t, bannedUntil.IsZero())
+}
+
+func TestScoreBoardDisabled(t *testing.T) {
+	sb := newScoreBoard(ScorePolicy{SpamRate: 1})
+
+	assert.Nil(t, sb.penalize("a", MisbehaviorDecodeFailure, 10))
+	assert.Nil(t, sb.onMessage("a"))
+	assert.Nil(t, sb.onMessage("a"))
+	assert.Nil(t, sb.checkBan("a"))
+	assert.Empty(t, sb.scores)
+}
+
+func TestPeersProxyBanDecodeFailures(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) {
+		cfg.Score.Enabled = true
+	})
+	chEvents, unsubscribe := a.SubscribePeerEvents(0)
+	defer unsubscribe()
+
+	h, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	assert.Nil(t, err)
+	defer func() {
+		_ = h.Close()
+	}()
+	aID, err := peer.Decode(a.GetID())
+	assert.Nil(t, err)
+	h.Peerstore().AddAddrs(aID, a.host.(host.Host).Addrs(), peerstore.PermanentAddrTTL)
+
+	// the score is kept across the sessions, the peer is disconnected for it a few times and
+	// then banned
+	var reasons []error
+	for len(reasons) == 0 || !errors.Is(reasons[len(reasons)-1], ErrPeerBanned) {
+		if !assert.Less(t, len(reasons), 10) {
+			return
+		}
+		stream, err := h.NewStream(context.Background(), aID, "peers.proxy.test")
+		if !assert.Nil(t, err) {
+			return
+		}
+		for i := 0; i < 5; i++ {
+			_ = p2pio.WriteFrame(stream, []byte{0})
+		}
+		reasons = append(reasons, waitPeerEvent(t, chEvents, PeerDisconnected, h.ID().Pretty()).Reason)
+		_ = stream.Reset()
+	}
+	assert.Greater(t, len(reasons), 1)
+	assert.ErrorIs(t, reasons[0], ErrPeerScoreLow)
+	_, bannedUntil := a.PeerScore(h.ID().Pretty())
+	assert.False(t, bannedUntil.IsZero())
+	assert.ErrorIs(t, a.checkPeer(h.ID().Pretty(), nil), ErrPeerBanned)
+}
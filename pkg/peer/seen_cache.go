@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSeenCacheSize = 100000
+	defaultSeenCacheTTL  = 10 * time.Minute
+)
+
+// SeenCacheStats counts the gossiped and published messages received from the peers, the
+// ones the host sends are recorded without being counted.
+type SeenCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64
+	Size      int
+}
+
+func (stats SeenCacheStats) HitRate() float64 {
+	if stats.Hits+stats.Misses == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+type seenEntry struct {
+	msgID string
+	at    time.Time
+}
+
+// seenCache is the gossip deduplication set, entries leave it after ttl without being seen
+// again or, least recently seen first, when it is full.
+type seenCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+	stats    SeenCacheStats
+	now      func() time.Time
+}
+
+func newSeenCache(capacity int, ttl time.Duration) *seenCache {
+	if capacity <= 0 {
+		capacity = defaultSeenCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultSeenCacheTTL
+	}
+	return &seenCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// seen records msgID and reports whether it was recorded before, it counts a hit or a miss.
+func (c *seenCache) seen(msgID string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.record(msgID) {
+		c.stats.Hits++
+		return true
+	}
+	c.stats.Misses++
+	return false
+}
+
+// add records msgID without counting it, for the messages sent by the host itself.
+func (c *seenCache) add(msgID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.record(msgID)
+}
+
+// record must be called with the lock held, it reports whether msgID was recorded before.
+func (c *seenCache) record(msgID string) bool {
+	now := c.now()
+	c.expire(now)
+
+	if e, ok := c.entries[msgID]; ok {
+		e.Value.(*seenEntry).at = now
+		c.order.MoveToBack(e)
+		return true
+	}
+
+	if c.order.Len() >= c.capacity {
+		c.remove(c.order.Front())
+		c.stats.Evictions++
+	}
+	c.entries[msgID] = c.order.PushBack(&seenEntry{
+		msgID: msgID,
+		at:    now,
+	})
+	return false
+}
+
+// contains reports whether msgID is recorded without recording it.
+func (c *seenCache) contains(msgID string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.expire(c.now())
+	_, ok := c.entries[msgID]
+	return ok
+}
+
+func (c *seenCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(*seenEntry).at) < c.ttl {
+			return
+		}
+		c.remove(e)
+		c.stats.Expired++
+	}
+}
+
+func (c *seenCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*seenEntry).msgID)
+	c.order.Remove(e)
+}
+
+func (c *seenCache) getStats() SeenCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.expire(c.now())
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
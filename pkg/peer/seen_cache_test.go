@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenCacheCapacity(t *testing.T) {
+	c := newSeenCache(3, time.Hour)
+	assert.False(t, c.seen("1"))
+	assert.False(t, c.seen("2"))
+	assert.False(t, c.seen("3"))
+	assert.True(t, c.seen("1"))
+	assert.False(t, c.seen("4"))
+
+	// "2" was the least recently seen one
+	assert.False(t, c.seen("2"))
+	assert.True(t, c.seen("4"))
+
+	stats := c.getStats()
+	assert.EqualValues(t, 2, stats.Hits)
+	assert.EqualValues(t, 5, stats.Misses)
+	assert.EqualValues(t, 2, stats.Evictions)
+	assert.Equal(t, 3, stats.Size)
+	assert.InDelta(t, 2.0/7.0, stats.HitRate(), 0.0001)
+}
+
+func TestSeenCacheTTL(t *testing.T) {
+	now := time.Now()
+	c := newSeenCache(10, time.Minute)
+	c.now = func() time.Time {
+		return now
+	}
+
+	assert.False(t, c.seen("1"))
+	now = now.Add(30 * time.Second)
+	assert.False(t, c.seen("2"))
+	now = now.Add(40 * time.Second)
+	assert.False(t, c.seen("1"))
+	assert.True(t, c.seen("2"))
+
+	stats := c.getStats()
+	assert.EqualValues(t, 1, stats.Expired)
+	assert.Equal(t, 2, stats.Size)
+}
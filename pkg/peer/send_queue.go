@@ -0,0 +1,277 @@
+package peer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSendQueueSize         = 64
+	defaultSendQueueControlSize  = 16
+	defaultSendQueueBlockTimeout = 5 * time.Second
+)
+
+// OverflowPolicy is what a peer does with a message sent while its send queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest fails the new message with ErrSendQueueFull, it is the default
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest fails the oldest queued message with ErrSendQueueFull to make room
+	OverflowDropOldest
+	// OverflowDisconnect fails the new message and closes the peer with ErrSendQueueFull
+	OverflowDisconnect
+	// OverflowBlock waits up to SendQueuePolicy.BlockTimeout for room, then fails the message
+	// with ErrSendQueueFull. The wait blocks the routine which delivers to every peer, a single
+	// slow peer delays all the others.
+	OverflowBlock
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowBlock:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// SendQueuePolicy bounds the outbound queue of every peer.
+type SendQueuePolicy struct {
+	// Size is the count of messages queued for a peer, PriorityControl ones excluded, 64 if <= 0
+	Size     int
+	Overflow OverflowPolicy
+	// ControlSize is the count of PriorityControl messages queued for a peer, 16 if <= 0. They
+	// are never dropped to make room, a new one is dropped instead whatever Overflow is.
+	ControlSize int
+	// BlockTimeout bounds the wait of OverflowBlock, 5 seconds if <= 0
+	BlockTimeout time.Duration
+}
+
+func (policy SendQueuePolicy) withDefaults() SendQueuePolicy {
+	if policy.Size <= 0 {
+		policy.Size = defaultSendQueueSize
+	}
+	if policy.ControlSize <= 0 {
+		policy.ControlSize = defaultSendQueueControlSize
+	}
+	if policy.BlockTimeout <= 0 {
+		policy.BlockTimeout = defaultSendQueueBlockTimeout
+	}
+	return policy
+}
+
+// sendQueue is the bounded outbound queue of a peer, the peer's routine pops it when notify fires.
+// Each Priority has its own list, pop takes the highest priority first. PriorityControl requests
+// are counted against ControlSize instead of Size.
+type sendQueue struct {
+	policy SendQueuePolicy
+
+	lock        sync.Mutex
+	requests    [priorityLevels]*list.List
+	size        int
+	controlSize int
+	closed      bool
+	overflowed  bool
+	// notify holds a token while a request is queued or the queue overflowed
+	notify chan struct{}
+	// chRoom wakes up the senders blocked on a full queue, waiting tells one is blocked
+	chRoom  chan struct{}
+	waiting bool
+}
+
+func newSendQueue(policy SendQueuePolicy) *sendQueue {
+	q := &sendQueue{
+		policy: policy.withDefaults(),
+		notify: make(chan struct{}, 1),
+		chRoom: make(chan struct{}),
+	}
+	for idx := range q.requests {
+		q.requests[idx] = list.New()
+	}
+	return q
+}
+
+func (q *sendQueue) add(req *peerRequest) {
+	q.requests[req.priority.level()].PushBack(req)
+	if req.priority == PriorityControl {
+		q.controlSize++
+	} else {
+		q.size++
+	}
+}
+
+// dropOldest removes the oldest request of the lowest priority not higher than priority.
+func (q *sendQueue) dropOldest(priority Priority) *peerRequest {
+	for level := priorityLevels - 1; level >= priority.level(); level-- {
+		if e := q.requests[level].Front(); e != nil {
+			q.size--
+			return q.requests[level].Remove(e).(*peerRequest)
+		}
+	}
+	return nil
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// push queues req, a full queue is handled by the overflow policy, block allows OverflowBlock
+// to wait. The error is also reported to req.
+func (q *sendQueue) push(req *peerRequest, block bool) error {
+	var deadline <-chan time.Time
+	for {
+		q.lock.Lock()
+		if q.closed {
+			q.lock.Unlock()
+			req.done(ErrPeerClosed)
+			return ErrPeerClosed
+		}
+		if req.priority == PriorityControl {
+			if q.controlSize >= q.policy.ControlSize {
+				q.lock.Unlock()
+				req.done(ErrSendQueueFull)
+				return ErrSendQueueFull
+			}
+			q.add(req)
+			q.lock.Unlock()
+			q.signal()
+			return nil
+		}
+		if q.size < q.policy.Size {
+			q.add(req)
+			q.lock.Unlock()
+			q.signal()
+			return nil
+		}
+
+		switch q.policy.Overflow {
+		case OverflowDropOldest:
+			dropped := q.dropOldest(req.priority)
+			if dropped == nil {
+				// everything queued is more important than req
+				q.lock.Unlock()
+				req.done(ErrSendQueueFull)
+				return ErrSendQueueFull
+			}
+			q.add(req)
+			q.lock.Unlock()
+			dropped.done(ErrSendQueueFull)
+			return nil
+		case OverflowDisconnect:
+			q.overflowed = true
+			q.lock.Unlock()
+			q.signal()
+			req.done(ErrSendQueueFull)
+			return ErrSendQueueFull
+		case OverflowBlock:
+			if block {
+				break
+			}
+			fallthrough
+		default:
+			q.lock.Unlock()
+			req.done(ErrSendQueueFull)
+			return ErrSendQueueFull
+		}
+
+		chRoom := q.chRoom
+		q.waiting = true
+		q.lock.Unlock()
+		if deadline == nil {
+			timer := time.NewTimer(q.policy.BlockTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-chRoom:
+		case <-deadline:
+			req.done(ErrSendQueueFull)
+			return ErrSendQueueFull
+		}
+	}
+}
+
+// pop returns nil if the queue is empty.
+func (q *sendQueue) pop() *peerRequest {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, requests := range q.requests {
+		e := requests.Front()
+		if e == nil {
+			continue
+		}
+		req := requests.Remove(e).(*peerRequest)
+		if req.priority == PriorityControl {
+			q.controlSize--
+		} else {
+			q.size--
+		}
+		if q.lengthLocked() > 0 {
+			q.signal()
+		}
+		q.wakeWaiting()
+		return req
+	}
+	return nil
+}
+
+func (q *sendQueue) lengthLocked() int {
+	n := 0
+	for _, requests := range q.requests {
+		n += requests.Len()
+	}
+	return n
+}
+
+func (q *sendQueue) wakeWaiting() {
+	if q.waiting {
+		close(q.chRoom)
+		q.chRoom = make(chan struct{})
+		q.waiting = false
+	}
+}
+
+func (q *sendQueue) isOverflowed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.overflowed
+}
+
+func (q *sendQueue) length() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.lengthLocked()
+}
+
+// close fails the queued requests with reason, later pushes fail with ErrPeerClosed.
+func (q *sendQueue) close(reason error) {
+	q.lock.Lock()
+	q.closed = true
+	requests := q.requests
+	for idx := range q.requests {
+		q.requests[idx] = list.New()
+	}
+	q.size, q.controlSize = 0, 0
+	q.wakeWaiting()
+	q.lock.Unlock()
+
+	for _, l := range requests {
+		for e := l.Front(); e != nil; e = e.Next() {
+			e.Value.(*peerRequest).done(reason)
+		}
+	}
+}
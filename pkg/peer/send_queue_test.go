@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPeerRequest(id string, results map[string]error) *peerRequest {
+	return &peerRequest{
+		msg: &testMessage{id: id},
+		fnResult: func(err error) {
+			results[id] = err
+		},
+	}
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	results := make(map[string]error)
+
+	q := newSendQueue(SendQueuePolicy{Size: 2, Overflow: OverflowDropNewest})
+	assert.Nil(t, q.push(newTestPeerRequest("1", results), true))
+	assert.Nil(t, q.push(newTestPeerRequest("2", results), true))
+	assert.ErrorIs(t, q.push(newTestPeerRequest("3", results), true), ErrSendQueueFull)
+	assert.ErrorIs(t, results["3"], ErrSendQueueFull)
+	ping := newTestPeerRequest("ping", results)
+	ping.priority = PriorityControl
+	assert.Nil(t, q.push(ping, false))
+	assert.Equal(t, 3, q.length())
+	assert.Equal(t, "ping", q.pop().msg.ID())
+
+	q = newSendQueue(SendQueuePolicy{Size: 2, Overflow: OverflowDropOldest})
+	assert.Nil(t, q.push(newTestPeerRequest("4", results), true))
+	assert.Nil(t, q.push(newTestPeerRequest("5", results), true))
+	assert.Nil(t, q.push(newTestPeerRequest("6", results), true))
+	assert.ErrorIs(t, results["4"], ErrSendQueueFull)
+	assert.Equal(t, "5", q.pop().msg.ID())
+
+	q = newSendQueue(SendQueuePolicy{Size: 1, Overflow: OverflowDisconnect})
+	assert.Nil(t, q.push(newTestPeerRequest("7", results), true))
+	assert.ErrorIs(t, q.push(newTestPeerRequest("8", results), true), ErrSendQueueFull)
+	assert.True(t, q.isOverflowed())
+	q.close(ErrPeerClosed)
+	assert.ErrorIs(t, results["7"], ErrPeerClosed)
+	assert.ErrorIs(t, q.push(newTestPeerRequest("9", results), true), ErrPeerClosed)
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	results := make(map[string]error)
+	fnPush := func(q *sendQueue, id string, priority Priority) error {
+		req := newTestPeerRequest(id, results)
+		req.priority = priority
+		return q.push(req, false)
+	}
+
+	q := newSendQueue(SendQueuePolicy{Size: 3, Overflow: OverflowDropOldest})
+	assert.Nil(t, fnPush(q, "bulk", PriorityBulk))
+	assert.Nil(t, fnPush(q, "normal", PriorityNormal))
+	assert.Nil(t, fnPush(q, "high", PriorityHigh))
+	assert.Nil(t, fnPush(q, "control", PriorityControl))
+
+	// the bulk message makes room
+	assert.Nil(t, fnPush(q, "high2", PriorityHigh))
+	assert.ErrorIs(t, results["bulk"], ErrSendQueueFull)
+	assert.Nil(t, fnPush(q, "normal2", PriorityNormal))
+	assert.ErrorIs(t, results["normal"], ErrSendQueueFull)
+	assert.Nil(t, fnPush(q, "high3", PriorityHigh))
+	assert.ErrorIs(t, results["normal2"], ErrSendQueueFull)
+	// nothing less important than bulk is left
+	assert.ErrorIs(t, fnPush(q, "bulk2", PriorityBulk), ErrSendQueueFull)
+
+	var ids []string
+	for req := q.pop(); req != nil; req = q.pop() {
+		ids = append(ids, req.msg.ID())
+	}
+	assert.Equal(t, []string{"control", "high", "high2", "high3"}, ids)
+
+	// the control messages have their own limit
+	q = newSendQueue(SendQueuePolicy{Size: 1, ControlSize: 2, Overflow: OverflowDropOldest})
+	assert.Nil(t, fnPush(q, "control1", PriorityControl))
+	assert.Nil(t, fnPush(q, "control2", PriorityControl))
+	assert.ErrorIs(t, fnPush(q, "control3", PriorityControl), ErrSendQueueFull)
+	assert.ErrorIs(t, results["control3"], ErrSendQueueFull)
+	assert.Nil(t, fnPush(q, "normal3", PriorityNormal))
+	assert.Equal(t, "control1", q.pop().msg.ID())
+	assert.Nil(t, fnPush(q, "control4", PriorityControl))
+	assert.Equal(t, 3, q.length())
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	results := make(map[string]error)
+
+	q := newSendQueue(SendQueuePolicy{Size: 1, Overflow: OverflowBlock, BlockTimeout: 20 * time.Millisecond})
+	assert.Nil(t, q.push(newTestPeerRequest("1", results), true))
+	assert.ErrorIs(t, q.push(newTestPeerRequest("2", results), false), ErrSendQueueFull)
+	assert.ErrorIs(t, q.push(newTestPeerRequest("3", results), true), ErrSendQueueFull)
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		q.pop()
+	}()
+	q.policy.BlockTimeout = time.Second
+	assert.Nil(t, q.push(newTestPeerRequest("4", results), true))
+	assert.Equal(t, "4", q.pop().msg.ID())
+}
+
+// testStuckPeer is a connected peer whose send queue is never written to its stream.
+type testStuckPeer struct {
+	PeerProxy
+	peerID string
+	queue  *sendQueue
+}
+
+func (peer *testStuckPeer) GetPeerID() string {
+	return peer.peerID
+}
+
+func (peer *testStuckPeer) DoRequest(req Message) {
+	peer.Send(req, nil)
+}
+
+func (peer *testStuckPeer) Send(req Message, fnResult func(err error)) {
+	_ = peer.queue.push(&peerRequest{msg: req, fnResult: fnResult}, true)
+}
+
+func TestSendQueueStuckPeer(t *testing.T) {
+	a := newTestNode(t, nil)
+	b := newTestNode(t, nil)
+	connectTestNodes(t, a, b)
+	// the default overflow policy
+	a.pr.chAddPeer <- &prPeerChange{
+		peer: &testStuckPeer{
+			peerID: "stuck",
+			queue:  newSendQueue(SendQueuePolicy{Size: 4}),
+		},
+	}
+
+	const n = 20
+	chDelivery := make(chan testDelivery, 2*n)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		a.Send("", a.newMessage(t, "hello"), func(peerID string, err error) {
+			chDelivery <- testDelivery{peerID: peerID, err: err}
+		})
+	}
+
+	// b gets everything at once while the queue of the stuck peer overflows
+	var delivered, full int
+	for delivered < n || full < n-4 {
+		select {
+		case delivery := <-chDelivery:
+			if delivery.peerID == b.GetID() {
+				assert.Nil(t, delivery.err)
+				delivered++
+			} else {
+				assert.ErrorIs(t, delivery.err, ErrSendQueueFull)
+				full++
+			}
+		case <-time.After(10 * time.Second):
+			assert.FailNow(t, "deliveries not reported")
+		}
+	}
+	for i := 0; i < n; i++ {
+		waitArrived(t, b)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+}
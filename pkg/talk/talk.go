@@ -6,7 +6,9 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/sgostarter/libp2p/pkg/p2pio"
 )
 
@@ -66,3 +68,44 @@ func Start(ctx context.Context, h interface{}, peerID, protocolID string,
 
 	return nil
 }
+
+// PeerAddrs returns the known multiaddrs of peerID in the peer store of h.
+func PeerAddrs(h interface{}, peerID string) []string {
+	ho, ok := h.(host.Host)
+	if !ok {
+		return nil
+	}
+
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		return nil
+	}
+
+	addrs := ho.Peerstore().Addrs(p)
+	ss := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ss = append(ss, addr.String())
+	}
+	return ss
+}
+
+// AddPeerAddr adds the full multiaddr addr (ending with /p2p/<peer id>) to the peer store of h
+// permanently and returns the peer ID.
+func AddPeerAddr(h interface{}, addr string) (string, error) {
+	ho, ok := h.(host.Host)
+	if !ok {
+		return "", errors.New("no host")
+	}
+
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return "", err
+	}
+	info, err := peer.AddrInfoFromP2pAddr(ma)
+	if err != nil {
+		return "", err
+	}
+
+	ho.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	return info.ID.Pretty(), nil
+}